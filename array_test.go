@@ -0,0 +1,89 @@
+package msgpack_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	msgpack "github.com/cjbottaro/msgpack_go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFixedArray(t *testing.T) {
+	in := [3]int{1, 2, 3}
+	data := msgpack.MustMarshal(in)
+	require.Equal(t, msgpack.MustMarshal([]int{1, 2, 3}), data)
+
+	var out [3]int
+	msgpack.MustUnmarshal(data, &out)
+	require.Equal(t, in, out)
+
+	// Arrays work as struct fields and map values too.
+	type S struct {
+		Pos [2]float64 `msgpack:"pos"`
+	}
+	var s S
+	msgpack.MustUnmarshal(msgpack.MustMarshal(S{Pos: [2]float64{1.5, -2}}), &s)
+	require.Equal(t, S{Pos: [2]float64{1.5, -2}}, s)
+}
+
+func TestFixedByteArray(t *testing.T) {
+	type Hash [4]byte
+
+	in := Hash{0xde, 0xad, 0xbe, 0xef}
+	data := msgpack.MustMarshal(in)
+	require.Equal(t, []byte{0xc4, 0x04, 0xde, 0xad, 0xbe, 0xef}, data)
+
+	// Addressable arrays take a different path.
+	require.Equal(t, data, msgpack.MustMarshal(&in))
+
+	var out Hash
+	msgpack.MustUnmarshal(data, &out)
+	require.Equal(t, in, out)
+
+	m := map[Hash]string{in: "foo"}
+	var mout map[Hash]string
+	msgpack.MustUnmarshal(msgpack.MustMarshal(m), &mout)
+	require.Equal(t, m, mout)
+}
+
+func TestFixedArrayLengthMismatch(t *testing.T) {
+	long := msgpack.MustMarshal([]int{1, 2, 3, 4})
+	short := msgpack.MustMarshal([]int{1})
+	longBin := msgpack.MustMarshal([]byte{1, 2, 3, 4})
+	shortBin := msgpack.MustMarshal([]byte{1})
+
+	var a [3]int
+	err := msgpack.Unmarshal(long, &a)
+	var ute *msgpack.UnmarshalTypeError
+	require.True(t, errors.As(err, &ute), "expected UnmarshalTypeError, got %v", err)
+	require.EqualError(t, err, "msgpack: cannot unmarshal array of length 4 into Go value of type [3]int")
+
+	require.Error(t, msgpack.Unmarshal(short, &a))
+
+	var b [3]byte
+	require.EqualError(t, msgpack.Unmarshal(longBin, &b), "msgpack: cannot unmarshal binary of length 4 into Go value of type [3]uint8")
+	require.Error(t, msgpack.Unmarshal(shortBin, &b))
+
+	decode := func(mode msgpack.FixedArrayMode, data []byte, v any) error {
+		dec := msgpack.NewDecoder(bytes.NewReader(data))
+		dec.SetFixedArrayMode(mode)
+		return dec.Decode(v)
+	}
+
+	a = [3]int{7, 7, 7}
+	require.NoError(t, decode(msgpack.FixedArrayTruncate, long, &a))
+	require.Equal(t, [3]int{1, 2, 3}, a)
+	require.Error(t, decode(msgpack.FixedArrayTruncate, short, &a))
+
+	a = [3]int{7, 7, 7}
+	require.NoError(t, decode(msgpack.FixedArrayZeroFill, short, &a))
+	require.Equal(t, [3]int{1, 0, 0}, a)
+	require.Error(t, decode(msgpack.FixedArrayZeroFill, long, &a))
+
+	b = [3]byte{7, 7, 7}
+	require.NoError(t, decode(msgpack.FixedArrayTruncate|msgpack.FixedArrayZeroFill, shortBin, &b))
+	require.Equal(t, [3]byte{1, 0, 0}, b)
+	require.NoError(t, decode(msgpack.FixedArrayTruncate|msgpack.FixedArrayZeroFill, longBin, &b))
+	require.Equal(t, [3]byte{1, 2, 3}, b)
+}
@@ -0,0 +1,94 @@
+package msgpack_test
+
+import (
+	"bytes"
+	"testing"
+
+	msgpack "github.com/cjbottaro/msgpack_go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMarshalCanonicalSortsKeys(t *testing.T) {
+	v := map[string]any{}
+	for _, k := range []string{"z", "a", "m", "b", "y", "c", "x", "d", "w", "e"} {
+		v[k] = map[any]any{k: 1, 2: k, 2.5: nil}
+	}
+
+	expected, err := msgpack.MarshalCanonical(v)
+	require.NoError(t, err)
+
+	for i := 0; i < 20; i++ {
+		data, err := msgpack.MarshalCanonical(v)
+		require.NoError(t, err)
+		require.Equal(t, expected, data)
+	}
+
+	var out map[string]map[any]any
+	msgpack.MustUnmarshal(expected, &out)
+	require.Len(t, out, len(v))
+}
+
+func TestMarshalCanonicalBytes(t *testing.T) {
+	data, err := msgpack.MarshalCanonical(map[string]int{"b": 2, "a": 1, "aa": 3})
+	require.NoError(t, err)
+	require.Equal(t, []byte{
+		0x83,
+		0xa1, 'a', 0x01,
+		0xa1, 'b', 0x02,
+		0xa2, 'a', 'a', 0x03,
+	}, data)
+}
+
+func TestMarshalCanonicalStruct(t *testing.T) {
+	type S struct {
+		B int `msgpack:"b"`
+		A int `msgpack:"a"`
+	}
+
+	data, err := msgpack.MarshalCanonical(S{B: 1, A: 2})
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x82, 0xa1, 'a', 0x02, 0xa1, 'b', 0x01}, data)
+
+	expected, err := msgpack.MarshalCanonical(map[string]any{"b": 1, "a": 2})
+	require.NoError(t, err)
+	require.Equal(t, expected, data)
+}
+
+func TestMarshalCanonicalIntegers(t *testing.T) {
+	// Without canonical output the format follows the Go type.
+	require.Equal(t, []byte{0xd1, 0x00, 0xc8}, msgpack.MustMarshal(int(200)))
+
+	for _, v := range []any{int(200), int16(200), uint8(200), uint64(200)} {
+		data, err := msgpack.MarshalCanonical(v)
+		require.NoError(t, err)
+		require.Equal(t, []byte{0xcc, 0xc8}, data, "%T", v)
+	}
+
+	data, err := msgpack.MarshalCanonical(int64(-200))
+	require.NoError(t, err)
+	require.Equal(t, []byte{0xd1, 0xff, 0x38}, data)
+}
+
+func TestMarshalCanonicalDuplicateKeys(t *testing.T) {
+	_, err := msgpack.MarshalCanonical(map[string]any{"m": map[any]any{int8(1): 2, uint64(1): 1}})
+	require.EqualError(t, err, "msgpack: duplicate map key at .m[1] in canonical encoding")
+
+	// Without canonical output the keys are written as they are.
+	_, err = msgpack.Marshal(map[any]any{int8(1): 2, uint64(1): 1})
+	require.NoError(t, err)
+}
+
+func TestEncoderSetCanonical(t *testing.T) {
+	v := map[int]string{3: "c", 1: "a", 2: "b"}
+
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCanonical(true)
+	require.NoError(t, enc.Encode(v))
+	require.NoError(t, enc.Flush())
+
+	expected, err := msgpack.MarshalCanonical(v)
+	require.NoError(t, err)
+	require.Equal(t, expected, buf.Bytes())
+	require.Equal(t, []byte{0x83, 0x01, 0xa1, 'a', 0x02, 0xa1, 'b', 0x03, 0xa1, 'c'}, expected)
+}
@@ -0,0 +1,129 @@
+package msgpack_test
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"testing"
+
+	msgpack "github.com/cjbottaro/msgpack_go"
+	"github.com/stretchr/testify/require"
+)
+
+func decodeWith(t *testing.T, data []byte, configure func(*msgpack.Decoder)) any {
+	t.Helper()
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	configure(dec)
+	var v any
+	require.NoError(t, dec.Decode(&v))
+	return v
+}
+
+func TestUnmarshalAnyMapTypes(t *testing.T) {
+	data := msgpack.MustMarshal(map[string]any{
+		"nested": map[string]any{"a": 1},
+		"mixed":  map[any]any{"a": 1, 2: "b"},
+		"list":   []any{map[string]any{}},
+	})
+
+	var v any
+	msgpack.MustUnmarshal(data, &v)
+	require.Equal(t, map[string]any{
+		"nested": map[string]any{"a": int64(1)},
+		"mixed":  map[any]any{"a": int64(1), int64(2): "b"},
+		"list":   []any{map[string]any{}},
+	}, v)
+
+	v = decodeWith(t, data, func(dec *msgpack.Decoder) { dec.SetMapMode(msgpack.MapAnyKeys) })
+	require.Equal(t, map[any]any{
+		"nested": map[any]any{"a": int64(1)},
+		"mixed":  map[any]any{"a": int64(1), int64(2): "b"},
+		"list":   []any{map[any]any{}},
+	}, v)
+
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetMapMode(msgpack.MapStringKeys)
+	var out any
+	require.EqualError(t, dec.Decode(&out), "msgpack: cannot unmarshal integer into Go value of type string at .mixed")
+
+	v = decodeWith(t, msgpack.MustMarshal(map[string]any{"a": 1}), func(dec *msgpack.Decoder) { dec.SetMapMode(msgpack.MapStringKeys) })
+	require.Equal(t, map[string]any{"a": int64(1)}, v)
+}
+
+func TestUnmarshalAnyUnhashableKey(t *testing.T) {
+	data := []byte{0x81, 0x91, 0x01, 0x02} // {[1] => 2}
+
+	var v any
+	require.Error(t, msgpack.Unmarshal(data, &v))
+
+	var m map[any]any
+	require.Error(t, msgpack.Unmarshal(data, &m))
+}
+
+func TestUnmarshalAnyIntModes(t *testing.T) {
+	data := msgpack.MustMarshal([]any{-1, uint8(200), uint64(math.MaxUint64)})
+
+	var v any
+	msgpack.MustUnmarshal(data, &v)
+	require.Equal(t, []any{int64(-1), uint64(200), uint64(math.MaxUint64)}, v)
+
+	v = decodeWith(t, data, func(dec *msgpack.Decoder) { dec.SetIntMode(msgpack.IntAsInt) })
+	require.Equal(t, []any{-1, 200, uint64(math.MaxUint64)}, v)
+
+	// Values outside an int's range fall back to int64 on 32-bit platforms.
+	n := int64(math.MinInt32) - 1
+	var expected any = int(n)
+	if strconv.IntSize == 32 {
+		expected = n
+	}
+	v = decodeWith(t, msgpack.MustMarshal(n), func(dec *msgpack.Decoder) { dec.SetIntMode(msgpack.IntAsInt) })
+	require.Equal(t, expected, v)
+
+	v = decodeWith(t, data, func(dec *msgpack.Decoder) { dec.SetIntMode(msgpack.IntAsNumber) })
+	require.Equal(t, []any{msgpack.Number("-1"), msgpack.Number("200"), msgpack.Number("18446744073709551615")}, v)
+
+	// Numbers encode back into the same integers.
+	require.Equal(t, msgpack.MustMarshal([]any{-1, uint8(200), uint64(math.MaxUint64)}), msgpack.MustMarshal(v))
+}
+
+func TestNumber(t *testing.T) {
+	type S struct {
+		N msgpack.Number `msgpack:"n"`
+	}
+
+	var s S
+	msgpack.MustUnmarshal(msgpack.MustMarshal(map[string]any{"n": -5}), &s)
+	require.Equal(t, msgpack.Number("-5"), s.N)
+
+	i, err := s.N.Int64()
+	require.NoError(t, err)
+	require.Equal(t, int64(-5), i)
+
+	_, err = s.N.Uint64()
+	require.Error(t, err)
+
+	f, err := msgpack.Number("1.5").Float64()
+	require.NoError(t, err)
+	require.Equal(t, 1.5, f)
+	require.Equal(t, msgpack.MustMarshal(1.5), msgpack.MustMarshal(msgpack.Number("1.5")))
+
+	_, err = msgpack.Marshal(msgpack.Number("nope"))
+	require.Error(t, err)
+}
+
+func TestUnmarshalAnyFloat32(t *testing.T) {
+	data := msgpack.MustMarshal([]any{float32(1.5), 2.5})
+
+	var v any
+	msgpack.MustUnmarshal(data, &v)
+	require.Equal(t, []any{1.5, 2.5}, v)
+
+	v = decodeWith(t, data, func(dec *msgpack.Decoder) { dec.SetKeepFloat32(true) })
+	require.Equal(t, []any{float32(1.5), 2.5}, v)
+}
+
+func TestUnmarshalAnyBoolAndBinary(t *testing.T) {
+	var v any
+	msgpack.MustUnmarshal(msgpack.MustMarshal([]any{true, false, []byte("abc"), []byte{}}), &v)
+	require.Equal(t, []any{true, false, []byte("abc"), []byte{}}, v)
+}
@@ -0,0 +1,153 @@
+package elixir
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	msgpack "github.com/cjbottaro/msgpack_go"
+)
+
+// Decimal is a number from Elixir's Decimal library, with the value
+// Sign * Coef * 10^Exp. Its ext data is the msgpack array [sign, coef, exp],
+// where coef is an integer, or a string of digits if it doesn't fit in a
+// uint64. Decimal's infinities and NaN aren't supported, and exponents
+// beyond ±1000000 are rejected when decoding, since String and Rat write out
+// every digit.
+type Decimal struct {
+	Sign int      // 1 or -1
+	Coef *big.Int // Never negative
+	Exp  int
+}
+
+// ParseDecimal parses a decimal number such as "-12.50", keeping all of its
+// digits.
+func ParseDecimal(s string) (Decimal, error) {
+	d := Decimal{Sign: 1}
+
+	digits := s
+	if strings.HasPrefix(digits, "-") {
+		d.Sign = -1
+		digits = digits[1:]
+	} else if strings.HasPrefix(digits, "+") {
+		digits = digits[1:]
+	}
+
+	if i := strings.IndexByte(digits, '.'); i >= 0 {
+		d.Exp = -(len(digits) - i - 1)
+		digits = digits[:i] + digits[i+1:]
+	}
+
+	coef, ok := new(big.Int).SetString(digits, 10)
+	if !ok || strings.ContainsAny(digits, "+-_") {
+		return Decimal{}, fmt.Errorf("elixir: invalid decimal %q", s)
+	}
+	d.Coef = coef
+
+	return d, nil
+}
+
+// String returns the number without an exponent, like Decimal.to_string/2
+// with :normal.
+func (d Decimal) String() string {
+	digits := "0"
+	if d.Coef != nil {
+		digits = d.Coef.String()
+	}
+
+	if d.Exp > 0 {
+		digits += strings.Repeat("0", d.Exp)
+	} else if d.Exp < 0 {
+		n := -d.Exp
+		if len(digits) <= n {
+			digits = strings.Repeat("0", n-len(digits)+1) + digits
+		}
+		digits = digits[:len(digits)-n] + "." + digits[len(digits)-n:]
+	}
+
+	if d.Sign < 0 {
+		return "-" + digits
+	}
+	return digits
+}
+
+// Rat returns the value of d.
+func (d Decimal) Rat() *big.Rat {
+	r := new(big.Rat)
+	if d.Coef != nil {
+		r.SetInt(d.Coef)
+	}
+
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(abs(d.Exp))), nil)
+	if d.Exp > 0 {
+		r.Mul(r, new(big.Rat).SetInt(scale))
+	} else if d.Exp < 0 {
+		r.Quo(r, new(big.Rat).SetInt(scale))
+	}
+
+	if d.Sign < 0 {
+		r.Neg(r)
+	}
+	return r
+}
+
+// maxExp is the largest exponent, either way, that is decoded.
+const maxExp = 1000000
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func registerDecimal(r *msgpack.ExtRegistry) error {
+	return msgpack.RegisterNestedExtIn(r, DecimalExt,
+		func(enc *msgpack.Encoder, d Decimal) error {
+			if d.Sign != 1 && d.Sign != -1 {
+				return fmt.Errorf("elixir: invalid decimal sign %d", d.Sign)
+			}
+
+			var coef any = uint64(0)
+			if d.Coef != nil {
+				if d.Coef.Sign() < 0 {
+					return errors.New("elixir: negative decimal coefficient")
+				}
+				if d.Coef.IsUint64() {
+					coef = d.Coef.Uint64()
+				} else {
+					coef = d.Coef.String()
+				}
+			}
+
+			return enc.Encode([]any{d.Sign, coef, d.Exp})
+		},
+		func(dec *msgpack.Decoder) (Decimal, error) {
+			var parts []msgpack.Number
+			if err := dec.Decode(&parts); err != nil {
+				return Decimal{}, err
+			}
+			if len(parts) != 3 {
+				return Decimal{}, fmt.Errorf("elixir: decimal has %d parts, expected 3", len(parts))
+			}
+
+			sign, err := parts[0].Int64()
+			if err != nil || (sign != 1 && sign != -1) {
+				return Decimal{}, fmt.Errorf("elixir: invalid decimal sign %s", parts[0])
+			}
+
+			coef, ok := new(big.Int).SetString(parts[1].String(), 10)
+			if !ok || coef.Sign() < 0 {
+				return Decimal{}, fmt.Errorf("elixir: invalid decimal coefficient %q", parts[1])
+			}
+
+			exp, err := parts[2].Int64()
+			if err != nil || exp < -maxExp || exp > maxExp {
+				return Decimal{}, fmt.Errorf("elixir: invalid decimal exponent %s", parts[2])
+			}
+
+			return Decimal{Sign: int(sign), Coef: coef, Exp: int(exp)}, nil
+		},
+	)
+}
@@ -0,0 +1,99 @@
+// Package elixir provides Go types for exchanging Elixir values with
+// services that use Msgpax, along with the ext types they are encoded as.
+//
+// Call Register with an ExtRegistry, usually msgpack.DefaultExtRegistry, to
+// make the types encode and decode as exts. The Elixir side needs matching
+// Msgpax.Packer implementations and an ext unpacker for the ids below; the
+// byte layout of each ext is documented on its Go type.
+package elixir
+
+import msgpack "github.com/cjbottaro/msgpack_go"
+
+// Ext types used for Elixir values.
+const (
+	AtomExt          int8 = 1
+	DateExt          int8 = 2
+	NaiveDateTimeExt int8 = 3
+	DateTimeExt      int8 = 4
+	DecimalExt       int8 = 5
+	TupleExt         int8 = 6
+	CharlistExt      int8 = 7
+)
+
+// Atom is an Elixir atom. Its ext data is the atom's name. Note that nil,
+// true and false are encoded by Msgpax as msgpack nil and booleans, not as
+// atoms.
+type Atom string
+
+// Charlist is an Elixir charlist, such as 'abc'. Its ext data is the
+// characters encoded as UTF-8.
+type Charlist string
+
+// Tuple is an Elixir tuple. Its ext data is a msgpack array of the elements,
+// which may themselves be any of the types in this package, or other exts
+// registered with the same ExtRegistry. Nested tuples count towards the
+// decoder's MaxDepth like nested arrays do.
+type Tuple []any
+
+// Register registers all of the types in this package with r. If any of them
+// can't be registered, r is left as it was.
+func Register(r *msgpack.ExtRegistry) error {
+	registrations := []struct {
+		typeId   int8
+		register func(*msgpack.ExtRegistry) error
+	}{
+		{AtomExt, registerAtom},
+		{DateExt, registerDate},
+		{NaiveDateTimeExt, registerNaiveDateTime},
+		{DateTimeExt, registerDateTime},
+		{DecimalExt, registerDecimal},
+		{TupleExt, registerTuple},
+		{CharlistExt, registerCharlist},
+	}
+
+	for i, reg := range registrations {
+		if err := reg.register(r); err != nil {
+			for _, done := range registrations[:i] {
+				r.Unregister(done.typeId)
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+func registerAtom(r *msgpack.ExtRegistry) error {
+	return msgpack.RegisterExtTypeIn(r, AtomExt,
+		func(a Atom) ([]byte, error) {
+			return []byte(a), nil
+		},
+		func(buf []byte) (Atom, error) {
+			return Atom(buf), nil
+		},
+	)
+}
+
+func registerCharlist(r *msgpack.ExtRegistry) error {
+	return msgpack.RegisterExtTypeIn(r, CharlistExt,
+		func(c Charlist) ([]byte, error) {
+			return []byte(c), nil
+		},
+		func(buf []byte) (Charlist, error) {
+			return Charlist(buf), nil
+		},
+	)
+}
+
+func registerTuple(r *msgpack.ExtRegistry) error {
+	return msgpack.RegisterNestedExtIn(r, TupleExt,
+		func(enc *msgpack.Encoder, t Tuple) error {
+			return enc.Encode([]any(t))
+		},
+		func(dec *msgpack.Decoder) (Tuple, error) {
+			elems := []any{}
+			err := dec.Decode(&elems)
+			return Tuple(elems), err
+		},
+	)
+}
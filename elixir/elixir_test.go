@@ -0,0 +1,264 @@
+package elixir_test
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"runtime"
+	"testing"
+	"time"
+
+	msgpack "github.com/cjbottaro/msgpack_go"
+	"github.com/cjbottaro/msgpack_go/elixir"
+	"github.com/stretchr/testify/require"
+)
+
+func newRegistry(t *testing.T) *msgpack.ExtRegistry {
+	r := msgpack.NewExtRegistry()
+	require.NoError(t, elixir.Register(r))
+	return r
+}
+
+func encode(t *testing.T, r *msgpack.ExtRegistry, v any) []byte {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetExtRegistry(r)
+	require.NoError(t, enc.Encode(v))
+	require.NoError(t, enc.Flush())
+	return buf.Bytes()
+}
+
+func decode(t *testing.T, r *msgpack.ExtRegistry, data []byte, v any) {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetExtRegistry(r)
+	require.NoError(t, dec.Decode(v))
+}
+
+func TestRegister(t *testing.T) {
+	r := newRegistry(t)
+
+	// Registering twice conflicts.
+	require.Error(t, elixir.Register(r))
+
+	// A failed call registers nothing.
+	type other string
+	r = msgpack.NewExtRegistry()
+	require.NoError(t, msgpack.RegisterExtTypeIn(r, elixir.CharlistExt,
+		func(o other) ([]byte, error) { return []byte(o), nil },
+		func(b []byte) (other, error) { return other(b), nil },
+	))
+	require.Error(t, elixir.Register(r))
+
+	_, ok := r.Lookup(elixir.AtomExt)
+	require.False(t, ok)
+	_, ok = r.Lookup(elixir.CharlistExt)
+	require.True(t, ok)
+}
+
+func TestElixirBytes(t *testing.T) {
+	r := newRegistry(t)
+
+	tests := []struct {
+		name  string
+		value any
+		data  []byte
+	}{
+		// :hello packed by Elixir
+		{"atom", elixir.Atom("hello"), []byte("\xC7\x05\x01hello")},
+		// ~D[2024-12-01] packed by Elixir
+		{"date", elixir.Date(time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC)), []byte("\xC7\x03\x02\x0Fс")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.data, encode(t, r, tt.value))
+
+			var v any
+			decode(t, r, tt.data, &v)
+			require.Equal(t, tt.value, v)
+		})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	r := newRegistry(t)
+
+	ny, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+
+	values := []any{
+		elixir.Atom("ok"),
+		elixir.Charlist("héllo"),
+		elixir.Date(time.Date(-44, 3, 15, 0, 0, 0, 0, time.UTC)),
+		elixir.NaiveDateTime(time.Date(2024, 11, 25, 2, 19, 12, 33203000, time.UTC)),
+		elixir.NaiveDateTime(time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)),
+		elixir.DateTime(time.Date(2024, 11, 25, 2, 19, 12, 33203000, time.UTC)),
+		elixir.DateTime(time.Date(2024, 7, 4, 12, 0, 0, 0, ny)),
+		elixir.Tuple{elixir.Atom("ok"), int64(1), "two"},
+		elixir.Tuple{},
+		elixir.Decimal{Sign: -1, Coef: big.NewInt(1250), Exp: -2},
+	}
+
+	for _, in := range values {
+		var out any
+		decode(t, r, encode(t, r, in), &out)
+		require.Equal(t, in, out)
+	}
+}
+
+func TestNested(t *testing.T) {
+	r := newRegistry(t)
+
+	in := map[string]any{
+		"result": elixir.Tuple{elixir.Atom("ok"), elixir.Tuple{elixir.Atom("user"), "jane"}},
+		"when":   elixir.Date(time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC)),
+	}
+
+	var out any
+	decode(t, r, encode(t, r, in), &out)
+	require.Equal(t, in, out)
+}
+
+func TestTupleDepth(t *testing.T) {
+	r := newRegistry(t)
+
+	// 20000 tuples, each holding the next, around a nil. The sizes are worked
+	// out from the inside so the data can be written from the outside in.
+	const depth = 20000
+	sizes := make([]int, depth+1)
+	sizes[0] = 1
+	for i := 1; i <= depth; i++ {
+		data := 1 + sizes[i-1]
+		sizes[i] = 4 + data
+		if data > 0xffff {
+			sizes[i] = 6 + data
+		}
+	}
+
+	var buf bytes.Buffer
+	for i := depth; i >= 1; i-- {
+		data := 1 + sizes[i-1]
+		if data > 0xffff {
+			buf.Write([]byte{0xc9, byte(data >> 24), byte(data >> 16), byte(data >> 8), byte(data)})
+		} else {
+			buf.Write([]byte{0xc8, byte(data >> 8), byte(data)})
+		}
+		buf.WriteByte(byte(elixir.TupleExt))
+		buf.WriteByte(0x91)
+	}
+	buf.WriteByte(0xc0)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	var v any
+	dec := msgpack.NewDecoder(bytes.NewReader(buf.Bytes()))
+	dec.SetExtRegistry(r)
+	err := dec.Decode(&v)
+
+	runtime.ReadMemStats(&after)
+
+	var le *msgpack.LimitError
+	require.True(t, errors.As(err, &le), "expected LimitError, got %v", err)
+	require.Equal(t, "MaxDepth", le.Limit)
+
+	// The data of each tuple is decoded in place rather than copied.
+	require.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(32<<20))
+}
+
+func TestNaiveDateTimeWallClock(t *testing.T) {
+	r := newRegistry(t)
+
+	// The zone is dropped, not converted.
+	in := time.Date(2024, 1, 2, 3, 4, 5, 0, time.FixedZone("UTC-3", -3*60*60))
+
+	var out elixir.NaiveDateTime
+	decode(t, r, encode(t, r, elixir.NaiveDateTime(in)), &out)
+	require.Equal(t, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), time.Time(out))
+}
+
+func TestDateTimeZone(t *testing.T) {
+	r := newRegistry(t)
+
+	in := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	data := encode(t, r, elixir.DateTime(in))
+	require.Equal(t, "Etc/UTC", string(data[len(data)-7:]))
+
+	// An unknown zone keeps its offset.
+	in = time.Date(2024, 1, 2, 3, 4, 5, 0, time.FixedZone("Mars/Olympus", 5*60*60))
+
+	var out elixir.DateTime
+	decode(t, r, encode(t, r, elixir.DateTime(in)), &out)
+	require.True(t, in.Equal(time.Time(out)))
+
+	name, offset := time.Time(out).Zone()
+	require.Equal(t, "Mars/Olympus", name)
+	require.Equal(t, 5*60*60, offset)
+}
+
+func TestDecimal(t *testing.T) {
+	r := newRegistry(t)
+
+	tests := []struct {
+		in   string
+		out  string
+		sign int
+		exp  int
+	}{
+		{"12.50", "12.50", 1, -2},
+		{"-0.001", "-0.001", -1, -3},
+		{"+7", "7", 1, 0},
+		{"123456789012345678901234567890.1", "123456789012345678901234567890.1", 1, -1},
+	}
+
+	for _, tt := range tests {
+		d, err := elixir.ParseDecimal(tt.in)
+		require.NoError(t, err)
+		require.Equal(t, tt.out, d.String())
+		require.Equal(t, tt.sign, d.Sign)
+		require.Equal(t, tt.exp, d.Exp)
+
+		var out elixir.Decimal
+		decode(t, r, encode(t, r, d), &out)
+		require.Equal(t, d, out)
+	}
+
+	require.Equal(t, "1200", elixir.Decimal{Sign: 1, Coef: big.NewInt(12), Exp: 2}.String())
+	require.Equal(t, big.NewRat(-1, 8), elixir.Decimal{Sign: -1, Coef: big.NewInt(125), Exp: -3}.Rat())
+
+	for _, s := range []string{"", "1e5", "1.2.3", "--1", "1.-2"} {
+		_, err := elixir.ParseDecimal(s)
+		require.Error(t, err, s)
+	}
+
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetExtRegistry(r)
+	require.Error(t, enc.Encode(elixir.Decimal{Sign: 0, Coef: big.NewInt(1)}))
+}
+
+func TestInvalidData(t *testing.T) {
+	r := newRegistry(t)
+
+	invalid := []msgpack.RawExt{
+		{Type: elixir.DateExt, Data: []byte{0x0f, 0xd1}},
+		{Type: elixir.DateExt, Data: []byte{0x0f, 0xd0, 0x00}}, // 2024-00-00
+		{Type: elixir.DateExt, Data: []byte{0x0f, 0xd1, 0xc1}}, // 2024-14-01
+		{Type: elixir.DateExt, Data: []byte{0x0f, 0xd1, 0x80}}, // 2024-12-00
+		{Type: elixir.DateExt, Data: []byte{0x0f, 0xd0, 0x5e}}, // 2024-02-30
+		{Type: elixir.NaiveDateTimeExt, Data: make([]byte, 8)},
+		{Type: elixir.DateTimeExt, Data: make([]byte, 12)},
+		{Type: elixir.DecimalExt, Data: msgpack.MustMarshal([]any{1, 2})},
+		{Type: elixir.DecimalExt, Data: msgpack.MustMarshal([]any{1, "x", 0})},
+		{Type: elixir.DecimalExt, Data: msgpack.MustMarshal([]any{1, 1, 1 << 40})},
+		{Type: elixir.DecimalExt, Data: msgpack.MustMarshal([]any{1, 1, -1 << 40})},
+		{Type: elixir.TupleExt, Data: append(msgpack.MustMarshal([]any{1}), 0x01)},
+	}
+
+	for _, raw := range invalid {
+		var v any
+		dec := msgpack.NewDecoder(bytes.NewReader(msgpack.MustMarshal(raw)))
+		dec.SetExtRegistry(r)
+		require.Error(t, dec.Decode(&v), "ext %d", raw.Type)
+	}
+}
@@ -0,0 +1,150 @@
+package elixir
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	msgpack "github.com/cjbottaro/msgpack_go"
+)
+
+// Date is an Elixir Date, held as midnight UTC of the day. Its ext data is
+// three bytes holding year<<9 | month<<5 | day as a big endian, two's
+// complement 24-bit integer, which covers years -16384 through 16383.
+type Date time.Time
+
+// NaiveDateTime is an Elixir NaiveDateTime, held as a time.Time in UTC whose
+// wall clock is the naive date and time. Its ext data is 12 bytes: the
+// nanoseconds as a big endian uint32, then the seconds since
+// 1970-01-01 00:00:00 as a big endian int64, the same as a 96-bit timestamp.
+// Elixir only keeps microseconds.
+type NaiveDateTime time.Time
+
+// DateTime is an Elixir DateTime, which has a time zone. Its ext data is 12
+// bytes of the instant laid out like NaiveDateTime, then the total UTC offset
+// in seconds as a big endian int32, then the name of the time zone.
+//
+// The time.Time's location gives the zone name, with UTC written as
+// "Etc/UTC" and time.Local as the zone's abbreviation. When decoding, zones
+// that can't be loaded, or whose offset doesn't match, are given a fixed
+// offset.
+type DateTime time.Time
+
+func registerDate(r *msgpack.ExtRegistry) error {
+	return msgpack.RegisterExtTypeIn(r, DateExt,
+		func(d Date) ([]byte, error) {
+			year, month, day := time.Time(d).Date()
+			if year < -16384 || year > 16383 {
+				return nil, errors.New("elixir: date year out of range")
+			}
+
+			val := year<<9 | int(month)<<5 | day
+			return []byte{byte(val >> 16), byte(val >> 8), byte(val)}, nil
+		},
+		func(buf []byte) (Date, error) {
+			if len(buf) != 3 {
+				return Date{}, errors.New("elixir: invalid date size")
+			}
+
+			// Shift the 24 bits to the top to sign extend the year.
+			val := int32(uint32(buf[0])<<24|uint32(buf[1])<<16|uint32(buf[2])<<8) >> 8
+			year := int(val >> 9)
+			month := time.Month(val >> 5 & 0xf)
+			day := int(val & 0x1f)
+
+			// time.Date normalizes a month or day that's out of range, so
+			// an invalid date comes back as a different one.
+			t := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+			if t.Month() != month || t.Day() != day {
+				return Date{}, errors.New("elixir: invalid date")
+			}
+
+			return Date(t), nil
+		},
+	)
+}
+
+func registerNaiveDateTime(r *msgpack.ExtRegistry) error {
+	return msgpack.RegisterExtTypeIn(r, NaiveDateTimeExt,
+		func(n NaiveDateTime) ([]byte, error) {
+			t := time.Time(n)
+			wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+			return putInstant(make([]byte, 12), wall), nil
+		},
+		func(buf []byte) (NaiveDateTime, error) {
+			if len(buf) != 12 {
+				return NaiveDateTime{}, errors.New("elixir: invalid naive datetime size")
+			}
+			t, err := instant(buf)
+			return NaiveDateTime(t), err
+		},
+	)
+}
+
+func registerDateTime(r *msgpack.ExtRegistry) error {
+	return msgpack.RegisterExtTypeIn(r, DateTimeExt,
+		func(dt DateTime) ([]byte, error) {
+			t := time.Time(dt)
+			abbr, offset := t.Zone()
+
+			zone := t.Location().String()
+			switch t.Location() {
+			case time.UTC:
+				zone = "Etc/UTC"
+			case time.Local:
+				zone = abbr
+			}
+
+			buf := putInstant(make([]byte, 16, 16+len(zone)), t)
+			binary.BigEndian.PutUint32(buf[12:], uint32(int32(offset)))
+			return append(buf, zone...), nil
+		},
+		func(buf []byte) (DateTime, error) {
+			if len(buf) < 16 {
+				return DateTime{}, errors.New("elixir: invalid datetime size")
+			}
+
+			t, err := instant(buf[:12])
+			if err != nil {
+				return DateTime{}, err
+			}
+
+			offset := int(int32(binary.BigEndian.Uint32(buf[12:16])))
+			return DateTime(t.In(zoneLocation(string(buf[16:]), offset, t))), nil
+		},
+	)
+}
+
+// zoneLocation returns the location named zone, or a fixed zone if it can't
+// be loaded or doesn't have the given offset at t.
+func zoneLocation(zone string, offset int, t time.Time) *time.Location {
+	if zone == "Etc/UTC" && offset == 0 {
+		return time.UTC
+	}
+
+	if loc, err := time.LoadLocation(zone); err == nil && zone != "Local" {
+		if _, o := t.In(loc).Zone(); o == offset {
+			return loc
+		}
+	}
+
+	return time.FixedZone(zone, offset)
+}
+
+// putInstant writes t into the first 12 bytes of buf like a 96-bit timestamp.
+func putInstant(buf []byte, t time.Time) []byte {
+	binary.BigEndian.PutUint32(buf[0:4], uint32(t.Nanosecond()))
+	binary.BigEndian.PutUint64(buf[4:12], uint64(t.Unix()))
+	return buf
+}
+
+func instant(buf []byte) (time.Time, error) {
+	nsec := int64(binary.BigEndian.Uint32(buf[0:4]))
+	sec := int64(binary.BigEndian.Uint64(buf[4:12]))
+
+	if nsec > 999999999 {
+		return time.Time{}, errors.New("elixir: nanoseconds out of range")
+	}
+
+	return time.Unix(sec, nsec).UTC(), nil
+}
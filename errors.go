@@ -0,0 +1,194 @@
+package msgpack
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// An UnmarshalTypeError describes a msgpack value that was not appropriate
+// for the Go value it was being decoded into.
+type UnmarshalTypeError struct {
+	Value  string       // description of the msgpack value, e.g. "string" or "integer 300"
+	Type   reflect.Type // type of the Go value it could not be assigned to
+	Offset int64        // offset of the value's first byte in the input
+	Format byte         // the value's format byte
+	Path   string       // path to the value from the root, e.g. ".items[3].price"
+
+	path valuePath
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	msg := fmt.Sprintf("msgpack: cannot unmarshal %s into Go value of type %v", e.Value, e.Type)
+	if e.Path != "" {
+		msg += " at " + e.Path
+	}
+	return msg
+}
+
+// A SyntaxError describes input that is not valid msgpack.
+type SyntaxError struct {
+	msg    string
+	Offset int64 // offset of the invalid byte in the input
+	Format byte  // the invalid format byte
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("msgpack: %s at offset %d", e.msg, e.Offset)
+}
+
+// An UnsupportedTypeError is returned when encoding a Go value of a type that
+// has no msgpack representation.
+type UnsupportedTypeError struct {
+	Type reflect.Type
+	Path string // path to the value from the root, e.g. ".items[3].price"
+
+	path valuePath
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	msg := "msgpack: unsupported type: " + e.Type.String()
+	if e.Path != "" {
+		msg += " at " + e.Path
+	}
+	return msg
+}
+
+// An ExtError is returned when an ext value cannot be decoded, either because
+// no ext is registered under its type or because the registered unmarshal
+// function failed.
+type ExtError struct {
+	Type   int8   // the ext's type
+	Offset int64  // offset of the value's first byte in the input
+	Path   string // path to the value from the root, e.g. ".items[3].price"
+	Err    error
+
+	path valuePath
+}
+
+func (e *ExtError) Error() string {
+	msg := fmt.Sprintf("msgpack: ext %d", e.Type)
+	if e.Path != "" {
+		msg += " at " + e.Path
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+func (e *ExtError) Unwrap() error {
+	return e.Err
+}
+
+var errUnregisteredExt = errors.New("unregistered ext")
+
+// duplicateKeyError is returned when two keys of a map encode the same in
+// canonical encoding.
+type duplicateKeyError struct {
+	path valuePath
+}
+
+func (e *duplicateKeyError) Error() string {
+	return fmt.Sprintf("msgpack: duplicate map key at %s in canonical encoding", e.path)
+}
+
+// pathElem is one step of a valuePath: a struct field, a map key or an array
+// index.
+type pathElem struct {
+	name  string
+	key   reflect.Value
+	index int
+}
+
+// valuePath is the path from the root to a value, held in reverse. Errors
+// collect it as they unwind out of the arrays, maps and structs they occurred
+// in, like encoding/json does, so nothing is spent on paths unless decoding
+// or encoding fails.
+type valuePath []pathElem
+
+// pathError is implemented by errors that report a path.
+type pathError interface {
+	addPath(e pathElem)
+	finishPath()
+}
+
+// withPath adds elem to the front of the path of err, if it reports one.
+func withPath(err error, elem pathElem) error {
+	var pe pathError
+	if errors.As(err, &pe) {
+		pe.addPath(elem)
+	}
+	return err
+}
+
+// finishPath sets the Path field of err from the path it collected. It is
+// called once err reaches the root.
+func finishPath(err error) error {
+	var pe pathError
+	if errors.As(err, &pe) {
+		pe.finishPath()
+	}
+	return err
+}
+
+func (e *UnmarshalTypeError) addPath(elem pathElem)   { e.path = append(e.path, elem) }
+func (e *UnsupportedTypeError) addPath(elem pathElem) { e.path = append(e.path, elem) }
+func (e *ExtError) addPath(elem pathElem)             { e.path = append(e.path, elem) }
+func (e *duplicateKeyError) addPath(elem pathElem)    { e.path = append(e.path, elem) }
+
+// Path may already hold the end of the path, set by an Encoder or Decoder
+// used inside a Marshaler, so finishPath adds the rest in front of it.
+func (e *UnmarshalTypeError) finishPath()   { e.Path, e.path = e.path.String()+e.Path, nil }
+func (e *UnsupportedTypeError) finishPath() { e.Path, e.path = e.path.String()+e.Path, nil }
+func (e *ExtError) finishPath()             { e.Path, e.path = e.path.String()+e.Path, nil }
+func (e *duplicateKeyError) finishPath()    {}
+
+// String renders the path, root first.
+func (p valuePath) String() string {
+	var sb strings.Builder
+
+	for i := len(p) - 1; i >= 0; i-- {
+		e := p[i]
+		switch {
+		case e.name != "":
+			sb.WriteString(".")
+			sb.WriteString(e.name)
+		case e.key.IsValid():
+			k := e.key
+			if k.Kind() == reflect.Interface {
+				k = k.Elem()
+			}
+			switch {
+			case !k.IsValid():
+				sb.WriteString("[nil]")
+			case k.Kind() == reflect.String:
+				sb.WriteString(".")
+				sb.WriteString(k.String())
+			default:
+				fmt.Fprintf(&sb, "[%v]", k.Interface())
+			}
+		default:
+			fmt.Fprintf(&sb, "[%d]", e.index)
+		}
+	}
+
+	return sb.String()
+}
+
+// typeError reports that the value being decoded, described by value, cannot
+// be stored in a Go value of type t.
+func (d *decodeState) typeError(value string, t reflect.Type) error {
+	return &UnmarshalTypeError{
+		Value:  value,
+		Type:   t,
+		Offset: d.start,
+		Format: d.format,
+	}
+}
+
+func (d *decodeState) extError(id int8, err error) error {
+	return &ExtError{Type: id, Offset: d.start, Err: err}
+}
+
+func syntaxError(b byte, offset int64) error {
+	return &SyntaxError{msg: fmt.Sprintf("invalid format byte 0x%02x", b), Offset: offset, Format: b}
+}
@@ -0,0 +1,122 @@
+package msgpack_test
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"unsafe"
+
+	msgpack "github.com/cjbottaro/msgpack_go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnmarshalTypeErrorPath(t *testing.T) {
+	type Item struct {
+		Price int8 `msgpack:"price"`
+	}
+
+	type Order struct {
+		Items []Item `msgpack:"items"`
+	}
+
+	item := map[string]any{"price": 1}
+	data := msgpack.MustMarshal(map[string]any{
+		"items": []any{item, item, item, map[string]any{"price": 300}},
+	})
+
+	var order Order
+	err := msgpack.Unmarshal(data, &order)
+
+	var ute *msgpack.UnmarshalTypeError
+	require.True(t, errors.As(err, &ute), "expected UnmarshalTypeError, got %v", err)
+	require.Equal(t, "integer 300", ute.Value)
+	require.Equal(t, reflect.TypeOf(int8(0)), ute.Type)
+	require.Equal(t, byte(0xd1), ute.Format)
+	require.Equal(t, int64(bytes.Index(data, []byte{0xd1, 0x01, 0x2c})), ute.Offset)
+	require.Equal(t, ".items[3].price", ute.Path)
+	require.EqualError(t, err, "msgpack: cannot unmarshal integer 300 into Go value of type int8 at .items[3].price")
+}
+
+func TestUnmarshalTypeErrorMapKeyPath(t *testing.T) {
+	var m map[int]map[string]bool
+	err := msgpack.Unmarshal(msgpack.MustMarshal(map[int]any{7: map[string]any{"ok": "yes"}}), &m)
+
+	var ute *msgpack.UnmarshalTypeError
+	require.True(t, errors.As(err, &ute), "expected UnmarshalTypeError, got %v", err)
+	require.Equal(t, "string", ute.Value)
+	require.Equal(t, "[7].ok", ute.Path)
+}
+
+func TestSyntaxError(t *testing.T) {
+	var v []int
+	err := msgpack.Unmarshal([]byte{0x92, 0x01, 0xc1}, &v)
+
+	var se *msgpack.SyntaxError
+	require.True(t, errors.As(err, &se), "expected SyntaxError, got %v", err)
+	require.Equal(t, int64(2), se.Offset)
+	require.Equal(t, byte(0xc1), se.Format)
+}
+
+func TestExtError(t *testing.T) {
+	var v []string
+	err := msgpack.Unmarshal([]byte{0x92, 0xc0, 0xd4, 0x64, 0x00}, &v)
+
+	var ee *msgpack.ExtError
+	require.True(t, errors.As(err, &ee), "expected ExtError, got %v", err)
+	require.Equal(t, int8(100), ee.Type)
+	require.Equal(t, int64(2), ee.Offset)
+	require.Equal(t, "[1]", ee.Path)
+}
+
+func TestDecoderErrorOffset(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(msgpack.MustMarshal("foo"))
+	buf.Write(msgpack.MustMarshal([]any{1, "bar"}))
+
+	dec := msgpack.NewDecoder(&buf)
+
+	var s string
+	require.NoError(t, dec.Decode(&s))
+
+	var v []int
+	err := dec.Decode(&v)
+
+	var ute *msgpack.UnmarshalTypeError
+	require.True(t, errors.As(err, &ute), "expected UnmarshalTypeError, got %v", err)
+	require.Equal(t, int64(6), ute.Offset)
+	require.Equal(t, "[1]", ute.Path)
+}
+
+func TestUnmarshalDefaultMaxDepth(t *testing.T) {
+	data := bytes.Repeat([]byte{0x91}, 20000)
+
+	var v any
+	requireLimitError(t, msgpack.Unmarshal(data, &v), "MaxDepth")
+}
+
+func TestMarshalUnsupportedType(t *testing.T) {
+	for _, v := range []any{make(chan int), func() {}, complex(1, 2), unsafe.Pointer(nil)} {
+		_, err := msgpack.Marshal(v)
+
+		var ute *msgpack.UnsupportedTypeError
+		require.True(t, errors.As(err, &ute), "expected UnsupportedTypeError for %T, got %v", v, err)
+		require.Equal(t, reflect.TypeOf(v), ute.Type)
+		require.Empty(t, ute.Path)
+	}
+
+	type S struct {
+		Callback func() `msgpack:"callback"`
+	}
+
+	_, err := msgpack.Marshal(map[string]any{"a": []any{1, S{}}})
+	require.EqualError(t, err, "msgpack: unsupported type: func() at .a[1].callback")
+
+	_, err = msgpack.MarshalCanonical(map[int]any{1: "ok", 2: complex64(1)})
+	require.EqualError(t, err, "msgpack: unsupported type: complex64 at [2]")
+}
+
+func TestMarshalNilAny(t *testing.T) {
+	require.Equal(t, []byte{0xc0}, msgpack.MustMarshal(nil))
+	require.Equal(t, []byte{0x05}, msgpack.MustMarshal(uintptr(5)))
+}
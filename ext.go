@@ -0,0 +1,262 @@
+package msgpack
+
+import (
+	"fmt"
+	"maps"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+type ExtMarshalFn func(any) ([]byte, error)
+type ExtUnmarshalFn func([]byte) (any, error)
+
+// RawExt is an ext value in its encoded form. Exts that aren't registered
+// decode into a RawExt when the target is an interface value, and a RawExt
+// encodes back into the same ext, so unknown exts survive a round trip. Any
+// ext, registered or not, can be decoded into a RawExt.
+type RawExt struct {
+	Type int8
+	Data []byte
+}
+
+type extHandler struct {
+	typ         reflect.Type
+	typeId      int8
+	marshalFn   ExtMarshalFn
+	unmarshalFn ExtUnmarshalFn
+
+	// Set instead of marshalFn and unmarshalFn for exts registered with
+	// RegisterNestedExtIn.
+	encodeFn func(*Encoder, any) error
+	decodeFn func(*Decoder) (any, error)
+}
+
+// An ExtRegistry maps Go types to msgpack ext types and back. Encoders and
+// decoders use DefaultExtRegistry unless given another one, so that different
+// parts of a program can give the same ext type different meanings.
+//
+// An ExtRegistry is safe for concurrent use. Lookups, which happen for every
+// value encoded, don't take a lock; registering copies the tables instead.
+type ExtRegistry struct {
+	mu     sync.Mutex // held while the tables are replaced
+	tables atomic.Pointer[extTables]
+}
+
+type extTables struct {
+	types   map[reflect.Type]extHandler
+	typeIds map[int8]extHandler
+}
+
+// DefaultExtRegistry is used by Marshal, Unmarshal and by new Encoders and
+// Decoders.
+var DefaultExtRegistry = NewExtRegistry()
+
+// NewExtRegistry returns an empty ExtRegistry.
+func NewExtRegistry() *ExtRegistry {
+	r := new(ExtRegistry)
+	r.tables.Store(&extTables{
+		types:   make(map[reflect.Type]extHandler),
+		typeIds: make(map[int8]extHandler),
+	})
+	return r
+}
+
+// RegisterExt registers an ext with DefaultExtRegistry; see
+// ExtRegistry.Register.
+func RegisterExt(v any, typeId int8, marshalFn ExtMarshalFn, unmarshalFn ExtUnmarshalFn) error {
+	return DefaultExtRegistry.Register(v, typeId, marshalFn, unmarshalFn)
+}
+
+// Register makes values of v's type encode as ext typeId using marshalFn, and
+// ext typeId decode using unmarshalFn. If v is a pointer, the type it points
+// to is registered, so (*T)(nil) can be used to register T.
+//
+// An error is returned if either the type or typeId is already registered.
+func (r *ExtRegistry) Register(v any, typeId int8, marshalFn ExtMarshalFn, unmarshalFn ExtUnmarshalFn) error {
+	t := reflect.TypeOf(v)
+	if t == nil {
+		return fmt.Errorf("msgpack: cannot register ext %d for nil", typeId)
+	}
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	return r.register(extHandler{
+		typ:         t,
+		typeId:      typeId,
+		marshalFn:   marshalFn,
+		unmarshalFn: unmarshalFn,
+	})
+}
+
+func (r *ExtRegistry) register(h extHandler) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	old := r.tables.Load()
+	if other, ok := old.typeIds[h.typeId]; ok {
+		return fmt.Errorf("msgpack: ext %d is already registered for %v", h.typeId, other.typ)
+	}
+	if other, ok := old.types[h.typ]; ok {
+		return fmt.Errorf("msgpack: %v is already registered as ext %d", h.typ, other.typeId)
+	}
+
+	cachedTypeInfo(h.typ).ext.Store(true)
+
+	tables := old.clone()
+	tables.types[h.typ] = h
+	tables.typeIds[h.typeId] = h
+	r.tables.Store(tables)
+
+	return nil
+}
+
+// Unregister removes ext typeId and the type registered for it, if any.
+func (r *ExtRegistry) Unregister(typeId int8) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	old := r.tables.Load()
+	if h, ok := old.typeIds[typeId]; ok {
+		tables := old.clone()
+		delete(tables.types, h.typ)
+		delete(tables.typeIds, typeId)
+		r.tables.Store(tables)
+	}
+}
+
+// Lookup returns the Go type registered for ext typeId.
+func (r *ExtRegistry) Lookup(typeId int8) (reflect.Type, bool) {
+	h, ok := r.byId(typeId)
+	return h.typ, ok
+}
+
+// LookupType returns the ext type that t is registered as.
+func (r *ExtRegistry) LookupType(t reflect.Type) (int8, bool) {
+	h, ok := r.byType(t)
+	return h.typeId, ok
+}
+
+func (r *ExtRegistry) byType(t reflect.Type) (extHandler, bool) {
+	h, ok := r.tables.Load().types[t]
+	return h, ok
+}
+
+func (r *ExtRegistry) byId(typeId int8) (extHandler, bool) {
+	h, ok := r.tables.Load().typeIds[typeId]
+	return h, ok
+}
+
+func (t *extTables) clone() *extTables {
+	return &extTables{
+		types:   maps.Clone(t.types),
+		typeIds: maps.Clone(t.typeIds),
+	}
+}
+
+// RegisterExtType registers T with DefaultExtRegistry; see RegisterExtTypeIn.
+func RegisterExtType[T any](typeId int8, marshalFn func(T) ([]byte, error), unmarshalFn func([]byte) (T, error)) error {
+	return RegisterExtTypeIn(DefaultExtRegistry, typeId, marshalFn, unmarshalFn)
+}
+
+// RegisterExtTypeIn is a type safe version of ExtRegistry.Register. Values of
+// type T encode as ext typeId using marshalFn, and ext typeId decodes using
+// unmarshalFn.
+//
+// If T is a pointer type *U, then U is registered and its values are passed
+// to and from the functions by pointer, which suits types whose methods have
+// pointer receivers.
+func RegisterExtTypeIn[T any](r *ExtRegistry, typeId int8, marshalFn func(T) ([]byte, error), unmarshalFn func([]byte) (T, error)) error {
+	t, toT, fromT, err := extType[T](typeId)
+	if err != nil {
+		return err
+	}
+
+	return r.register(extHandler{
+		typ:    t,
+		typeId: typeId,
+		marshalFn: func(v any) ([]byte, error) {
+			return marshalFn(toT(v))
+		},
+		unmarshalFn: func(data []byte) (any, error) {
+			v, err := unmarshalFn(data)
+			if err != nil {
+				return nil, err
+			}
+			return fromT(v)
+		},
+	})
+}
+
+// RegisterNestedExt registers T with DefaultExtRegistry; see
+// RegisterNestedExtIn.
+func RegisterNestedExt[T any](typeId int8, encodeFn func(*Encoder, T) error, decodeFn func(*Decoder) (T, error)) error {
+	return RegisterNestedExtIn(DefaultExtRegistry, typeId, encodeFn, decodeFn)
+}
+
+// RegisterNestedExtIn registers T with r as ext typeId, with encodeFn and
+// decodeFn writing and reading the ext's data as msgpack.
+//
+// The Encoder and Decoder carry the settings of the ones that came across the
+// ext, including their ExtRegistry and Limits, so the data can hold other
+// exts. Nesting inside the data counts towards MaxDepth and what it allocates
+// towards MaxAlloc. decodeFn must read all of the data.
+//
+// Pointer types are handled as by RegisterExtTypeIn.
+func RegisterNestedExtIn[T any](r *ExtRegistry, typeId int8, encodeFn func(*Encoder, T) error, decodeFn func(*Decoder) (T, error)) error {
+	t, toT, fromT, err := extType[T](typeId)
+	if err != nil {
+		return err
+	}
+
+	return r.register(extHandler{
+		typ:    t,
+		typeId: typeId,
+		encodeFn: func(enc *Encoder, v any) error {
+			return encodeFn(enc, toT(v))
+		},
+		decodeFn: func(dec *Decoder) (any, error) {
+			v, err := decodeFn(dec)
+			if err != nil {
+				return nil, err
+			}
+			return fromT(v)
+		},
+	})
+}
+
+// extType returns the type that registering T as ext typeId registers, along
+// with functions converting between T and the values of that type.
+func extType[T any](typeId int8) (reflect.Type, func(any) T, func(T) (any, error), error) {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+
+	switch t.Kind() {
+	case reflect.Interface:
+		return nil, nil, nil, fmt.Errorf("msgpack: cannot register interface type %v as ext %d", t, typeId)
+
+	case reflect.Pointer:
+		toT := func(v any) T {
+			p := reflect.New(t.Elem())
+			p.Elem().Set(reflect.ValueOf(v))
+			return p.Interface().(T)
+		}
+		fromT := func(v T) (any, error) {
+			p := reflect.ValueOf(v)
+			if p.IsNil() {
+				return nil, fmt.Errorf("msgpack: ext %d unmarshal function returned nil", typeId)
+			}
+			return p.Elem().Interface(), nil
+		}
+		return t.Elem(), toT, fromT, nil
+
+	default:
+		toT := func(v any) T {
+			return v.(T)
+		}
+		fromT := func(v T) (any, error) {
+			return v, nil
+		}
+		return t, toT, fromT, nil
+	}
+}
@@ -0,0 +1,365 @@
+package msgpack_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	msgpack "github.com/cjbottaro/msgpack_go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type Upper string
+
+func registerUpper(r *msgpack.ExtRegistry, typeId int8) error {
+	return r.Register((*Upper)(nil), typeId,
+		func(v any) ([]byte, error) {
+			return []byte(strings.ToUpper(string(v.(Upper)))), nil
+		},
+		func(buf []byte) (any, error) {
+			return Upper(buf), nil
+		},
+	)
+}
+
+func TestExtRegistryDuplicates(t *testing.T) {
+	r := msgpack.NewExtRegistry()
+	require.NoError(t, registerUpper(r, 1))
+
+	require.EqualError(t, registerUpper(r, 2), "msgpack: msgpack_test.Upper is already registered as ext 1")
+
+	err := r.Register(Atom(""), 1, nil, nil)
+	require.EqualError(t, err, "msgpack: ext 1 is already registered for msgpack_test.Upper")
+
+	// The global registry already has Atom on 1.
+	require.Error(t, msgpack.RegisterExt(Upper(""), 1, nil, nil))
+}
+
+func TestExtRegistryLookup(t *testing.T) {
+	r := msgpack.NewExtRegistry()
+	require.NoError(t, registerUpper(r, 5))
+
+	typ, ok := r.Lookup(5)
+	require.True(t, ok)
+	require.Equal(t, reflect.TypeOf(Upper("")), typ)
+
+	id, ok := r.LookupType(reflect.TypeOf(Upper("")))
+	require.True(t, ok)
+	require.Equal(t, int8(5), id)
+
+	r.Unregister(5)
+	_, ok = r.Lookup(5)
+	require.False(t, ok)
+	_, ok = r.LookupType(reflect.TypeOf(Upper("")))
+	require.False(t, ok)
+
+	// Both the id and the type are free again.
+	require.NoError(t, registerUpper(r, 6))
+}
+
+func TestExtRegistryPerEncoder(t *testing.T) {
+	r := msgpack.NewExtRegistry()
+	require.NoError(t, registerUpper(r, 1))
+
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetExtRegistry(r)
+	require.NoError(t, enc.Encode(Upper("foo")))
+	require.NoError(t, enc.Flush())
+	require.Equal(t, []byte{0xc7, 0x03, 0x01, 'F', 'O', 'O'}, buf.Bytes())
+
+	// The same bytes mean an Atom to the default registry.
+	var v any
+	msgpack.MustUnmarshal(buf.Bytes(), &v)
+	require.Equal(t, Atom("FOO"), v)
+
+	v = nil
+	dec := msgpack.NewDecoder(bytes.NewReader(buf.Bytes()))
+	dec.SetExtRegistry(r)
+	require.NoError(t, dec.Decode(&v))
+	require.Equal(t, Upper("FOO"), v)
+
+	// Exts only registered with the default registry are unknown to r.
+	dec = msgpack.NewDecoder(bytes.NewReader(msgpack.MustMarshal(Date{})))
+	dec.SetExtRegistry(r)
+	var date Date
+	var ee *msgpack.ExtError
+	require.True(t, errors.As(dec.Decode(&date), &ee))
+}
+
+func TestExtRegistryConcurrent(t *testing.T) {
+	r := msgpack.NewExtRegistry()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				registerUpper(r, 1)
+				r.Unregister(1)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				var buf bytes.Buffer
+				enc := msgpack.NewEncoder(&buf)
+				enc.SetExtRegistry(r)
+				assert.NoError(t, enc.Encode(Upper("foo")))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSetExtRegistryNil(t *testing.T) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetExtRegistry(nil)
+	require.NoError(t, enc.Encode(Atom("foo")))
+	require.NoError(t, enc.Flush())
+
+	// Nil means the default registry, where Atom is registered.
+	require.Equal(t, msgpack.MustMarshal(Atom("foo")), buf.Bytes())
+
+	dec := msgpack.NewDecoder(&buf)
+	dec.SetExtRegistry(nil)
+	var v any
+	require.NoError(t, dec.Decode(&v))
+	require.Equal(t, Atom("foo"), v)
+}
+
+// Counter2 has pointer receivers, so it is registered through *Counter2.
+type Counter2 struct {
+	n int
+}
+
+func (c *Counter2) Bytes() []byte {
+	return []byte{byte(c.n)}
+}
+
+func (c *Counter2) SetBytes(b []byte) {
+	c.n = int(b[0])
+}
+
+type Money struct {
+	Currency string
+	Cents    int64
+}
+
+func TestRegisterExtTypePointer(t *testing.T) {
+	r := msgpack.NewExtRegistry()
+	err := msgpack.RegisterExtTypeIn(r, 7,
+		func(c *Counter2) ([]byte, error) {
+			return c.Bytes(), nil
+		},
+		func(b []byte) (*Counter2, error) {
+			c := new(Counter2)
+			c.SetBytes(b)
+			return c, nil
+		},
+	)
+	require.NoError(t, err)
+
+	typ, ok := r.Lookup(7)
+	require.True(t, ok)
+	require.Equal(t, reflect.TypeOf(Counter2{}), typ)
+
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetExtRegistry(r)
+	require.NoError(t, enc.Encode(map[string]Counter2{"c": {n: 3}}))
+	require.NoError(t, enc.Encode(&Counter2{n: 4}))
+	require.NoError(t, enc.Flush())
+
+	dec := msgpack.NewDecoder(&buf)
+	dec.SetExtRegistry(r)
+
+	var m map[string]Counter2
+	require.NoError(t, dec.Decode(&m))
+	require.Equal(t, map[string]Counter2{"c": {n: 3}}, m)
+
+	var c *Counter2
+	require.NoError(t, dec.Decode(&c))
+	require.Equal(t, &Counter2{n: 4}, c)
+}
+
+func TestRegisterExtTypeInterface(t *testing.T) {
+	err := msgpack.RegisterExtTypeIn(msgpack.NewExtRegistry(), 7,
+		func(error) ([]byte, error) { return nil, nil },
+		func([]byte) (error, error) { return nil, nil },
+	)
+	require.Error(t, err)
+}
+
+func TestRegisterNestedExt(t *testing.T) {
+	err := msgpack.RegisterNestedExt(8,
+		func(enc *msgpack.Encoder, m Money) error {
+			return enc.Encode([]any{m.Currency, m.Cents})
+		},
+		func(dec *msgpack.Decoder) (Money, error) {
+			var m Money
+			var parts []any
+			if err := dec.Decode(&parts); err != nil {
+				return m, err
+			}
+			m.Currency, _ = parts[0].(string)
+			m.Cents, _ = parts[1].(int64)
+			return m, nil
+		},
+	)
+	require.NoError(t, err)
+	defer msgpack.DefaultExtRegistry.Unregister(8)
+
+	data := msgpack.MustMarshal(Money{"EUR", -250})
+
+	// The ext's data is itself msgpack.
+	var raw msgpack.RawExt
+	msgpack.MustUnmarshal(data, &raw)
+	require.Equal(t, msgpack.MustMarshal([]any{"EUR", -250}), raw.Data)
+
+	var v any
+	msgpack.MustUnmarshal(data, &v)
+	require.Equal(t, Money{"EUR", -250}, v)
+
+	// Leftover data is an error.
+	data = msgpack.MustMarshal(msgpack.RawExt{Type: 8, Data: append(msgpack.MustMarshal([]any{"EUR", 1}), 0x01)})
+	require.Error(t, msgpack.Unmarshal(data, &v))
+}
+
+// Box holds any value, which may itself be an ext.
+type Box struct {
+	V any
+}
+
+func registerBox(t *testing.T, r *msgpack.ExtRegistry) {
+	err := msgpack.RegisterNestedExtIn(r, 9,
+		func(enc *msgpack.Encoder, b Box) error {
+			return enc.Encode(b.V)
+		},
+		func(dec *msgpack.Decoder) (Box, error) {
+			var b Box
+			err := dec.Decode(&b.V)
+			return b, err
+		},
+	)
+	require.NoError(t, err)
+}
+
+func TestRegisterNestedExtIn(t *testing.T) {
+	r := msgpack.NewExtRegistry()
+	require.NoError(t, registerUpper(r, 1))
+	registerBox(t, r)
+
+	// The data can hold exts from the same registry.
+	in := Box{[]any{Upper("FOO"), Box{"bar"}}}
+
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetExtRegistry(r)
+	require.NoError(t, enc.Encode(in))
+	require.NoError(t, enc.Flush())
+
+	dec := msgpack.NewDecoder(bytes.NewReader(buf.Bytes()))
+	dec.SetExtRegistry(r)
+	var out any
+	require.NoError(t, dec.Decode(&out))
+	require.Equal(t, in, out)
+
+	// The decoder's limits apply inside the data.
+	dec = msgpack.NewDecoder(bytes.NewReader(buf.Bytes()))
+	dec.SetExtRegistry(r)
+	dec.SetLimits(msgpack.Limits{MaxStringLen: 2})
+	requireLimitError(t, dec.Decode(&out), "MaxStringLen")
+
+	// Leftover data is an error.
+	data := append([]byte{0xc7, 0x02, 9}, 0x01, 0x02)
+	dec = msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetExtRegistry(r)
+	require.Error(t, dec.Decode(&out))
+}
+
+func TestNestedExtUnexpectedEOF(t *testing.T) {
+	r := msgpack.NewExtRegistry()
+	registerBox(t, r)
+
+	// The Box's data is empty, so decoding it runs out of input.
+	dec := msgpack.NewDecoder(bytes.NewReader([]byte{0x91, 0xc7, 0x00, 9}))
+	dec.SetExtRegistry(r)
+
+	var out any
+	err := dec.Decode(&out)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	var ee *msgpack.ExtError
+	require.True(t, errors.As(err, &ee))
+	require.Equal(t, int64(1), ee.Offset)
+	require.Equal(t, "[0]", ee.Path)
+}
+
+func TestNestedExtErrorPath(t *testing.T) {
+	r := msgpack.NewExtRegistry()
+	registerBox(t, r)
+
+	// Paths run from the root through the data of enclosing exts.
+	enc := msgpack.NewEncoder(&bytes.Buffer{})
+	enc.SetExtRegistry(r)
+	err := enc.Encode([]any{nil, Box{[]any{Box{make(chan int)}}}})
+
+	var ute *msgpack.UnsupportedTypeError
+	require.True(t, errors.As(err, &ute), "expected UnsupportedTypeError, got %v", err)
+	require.Equal(t, "[1][0]", ute.Path)
+
+	// The inner Box's data is empty, so decoding it runs out of input.
+	data := []byte{0x91, 0xc7, 0x05, 9, 0x92, 0xc0, 0xc7, 0x00, 9}
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetExtRegistry(r)
+
+	var out any
+	err = dec.Decode(&out)
+
+	var ee *msgpack.ExtError
+	require.True(t, errors.As(err, &ee), "expected ExtError, got %v", err)
+	require.Equal(t, int64(6), ee.Offset)
+	require.Equal(t, "[0][1]", ee.Path)
+}
+
+func TestRegisterNestedExtInDepth(t *testing.T) {
+	r := msgpack.NewExtRegistry()
+	registerBox(t, r)
+
+	// Nesting exts counts towards MaxDepth, as their arrays do.
+	var v any = "x"
+	for i := 0; i < 100; i++ {
+		v = Box{[]any{v}}
+	}
+
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetExtRegistry(r)
+	require.NoError(t, enc.Encode(v))
+	require.NoError(t, enc.Flush())
+
+	dec := msgpack.NewDecoder(bytes.NewReader(buf.Bytes()))
+	dec.SetExtRegistry(r)
+	dec.SetLimits(msgpack.Limits{MaxDepth: 50})
+	var out any
+	err := dec.Decode(&out)
+	requireLimitError(t, err, "MaxDepth")
+
+	// The error is only wrapped once, however deep it happened.
+	var ee *msgpack.ExtError
+	require.True(t, errors.As(err, &ee))
+	require.False(t, errors.As(ee.Err, &ee))
+
+	dec = msgpack.NewDecoder(bytes.NewReader(buf.Bytes()))
+	dec.SetExtRegistry(r)
+	require.NoError(t, dec.Decode(&out))
+	require.Equal(t, v, out)
+}
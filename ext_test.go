@@ -14,20 +14,18 @@ type Atom string
 type Date time.Time
 
 func init() {
-	msgpack.RegisterExt((*time.Time)(nil), -0x01, msgpack.MarshalTimeExt, msgpack.UnmarshalTimeExt)
-
-	msgpack.RegisterExt((*Atom)(nil), 0x01,
-		func(v any) ([]byte, error) {
-			return []byte(v.(Atom)), nil
+	msgpack.RegisterExtType(0x01,
+		func(a Atom) ([]byte, error) {
+			return []byte(a), nil
 		},
-		func(buf []byte) (any, error) {
+		func(buf []byte) (Atom, error) {
 			return Atom(buf), nil
 		},
 	)
 
-	msgpack.RegisterExt((*Date)(nil), 0x02,
-		func(v any) ([]byte, error) {
-			t := time.Time(v.(Date))
+	msgpack.RegisterExtType(0x02,
+		func(d Date) ([]byte, error) {
+			t := time.Time(d)
 			year, month, day := t.Date()
 
 			if year < -16384 || year > 16383 {
@@ -43,9 +41,9 @@ func init() {
 
 			return enc[:], nil
 		},
-		func(buf []byte) (any, error) {
+		func(buf []byte) (Date, error) {
 			if len(buf) != 3 {
-				return nil, fmt.Errorf("invalid length for date ext data")
+				return Date{}, fmt.Errorf("invalid length for date ext data")
 			}
 			val := (int(buf[0]) << 16) | (int(buf[1]) << 8) | int(buf[2])
 
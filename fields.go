@@ -0,0 +1,336 @@
+package msgpack
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// _fieldCache holds the *structFields for each struct type seen so far.
+var _fieldCache sync.Map // map[reflect.Type]*structFields
+
+// structFields is the precomputed field metadata for a struct type, shared by
+// the encoder and decoder.
+type structFields struct {
+	list    []field
+	sorted  []field        // list sorted by key, for canonical encoding
+	byName  map[string]int // index into list
+	byInt   map[int64]int  // index into list, for keyasint fields
+	asArray bool           // encode as an array of field values
+}
+
+// field is a struct field as seen by the encoder and decoder, after embedded
+// structs have been flattened into their parent.
+type field struct {
+	name   string
+	key    []byte // name, or intKey, encoded as msgpack
+	tagged bool   // name came from a struct tag
+	index  []int  // index sequence for reflect.Value.FieldByIndex
+	typ    reflect.Type
+
+	keyAsInt bool
+	intKey   int64
+
+	omitEmpty bool
+	omitZero  bool
+	quoted    bool
+}
+
+// cachedTypeFields is like typeFields but only does the work once per type.
+func cachedTypeFields(t reflect.Type) *structFields {
+	if f, ok := _fieldCache.Load(t); ok {
+		return f.(*structFields)
+	}
+
+	fields := &structFields{
+		list:   typeFields(t),
+		byName: map[string]int{},
+		byInt:  map[int64]int{},
+	}
+	for i := range fields.list {
+		f := &fields.list[i]
+		fields.byName[f.name] = i
+		if f.keyAsInt {
+			fields.byInt[f.intKey] = i
+		}
+	}
+
+	fields.sorted = slices.Clone(fields.list)
+	slices.SortFunc(fields.sorted, func(a, b field) int {
+		return bytes.Compare(a.key, b.key)
+	})
+
+	// Struct level options are set on a blank field, e.g.
+	//   _ struct{} `msgpack:",asarray"`
+	for i := 0; i < t.NumField(); i++ {
+		if sf := t.Field(i); sf.Name == "_" {
+			_, opts := parseTag(fieldTag(sf))
+			fields.asArray = fields.asArray || opts.Contains("asarray")
+		}
+	}
+
+	f, _ := _fieldCache.LoadOrStore(t, fields)
+	return f.(*structFields)
+}
+
+// typeFields returns the fields of struct type t that take part in encoding
+// and decoding. Fields of embedded structs are promoted into t following the
+// same visibility and conflict rules as encoding/json: shallower fields shadow
+// deeper ones, and among fields at the same depth a tagged field wins. If that
+// still leaves more than one candidate, all of them are dropped.
+func typeFields(t reflect.Type) []field {
+	// Embedded structs left to explore at the current and next depth.
+	current := []field{}
+	next := []field{{typ: t}}
+
+	// Count of queued names for current level and the next.
+	var count, nextCount map[reflect.Type]int
+
+	// Types already visited at an earlier level.
+	visited := map[reflect.Type]bool{}
+
+	var fields []field
+
+	for len(next) > 0 {
+		current, next = next, current[:0]
+		count, nextCount = nextCount, map[reflect.Type]int{}
+
+		for _, f := range current {
+			if visited[f.typ] {
+				continue
+			}
+			visited[f.typ] = true
+
+			for i := 0; i < f.typ.NumField(); i++ {
+				sf := f.typ.Field(i)
+
+				if sf.Anonymous {
+					ft := sf.Type
+					if ft.Kind() == reflect.Pointer {
+						ft = ft.Elem()
+					}
+					// Embedded structs of unexported types may still have
+					// exported fields to promote.
+					if !sf.IsExported() && ft.Kind() != reflect.Struct {
+						continue
+					}
+				} else if !sf.IsExported() {
+					continue
+				}
+
+				tag := fieldTag(sf)
+				if tag == "-" {
+					continue
+				}
+
+				name, opts := parseTag(tag)
+
+				index := make([]int, len(f.index)+1)
+				copy(index, f.index)
+				index[len(f.index)] = i
+
+				ft := sf.Type
+				if ft.Name() == "" && ft.Kind() == reflect.Pointer {
+					ft = ft.Elem()
+				}
+
+				// Record found field and index sequence.
+				if name != "" || !sf.Anonymous || ft.Kind() != reflect.Struct {
+					tagged := name != ""
+					if name == "" {
+						name = sf.Name
+					}
+					fields = append(fields, newField(name, tagged, index, ft, opts))
+					if count[f.typ] > 1 {
+						// If there were multiple instances, add a second, so
+						// that the conflict resolution below drops the field.
+						fields = append(fields, fields[len(fields)-1])
+					}
+					continue
+				}
+
+				// Record new anonymous struct to explore in next round.
+				nextCount[ft]++
+				if nextCount[ft] == 1 {
+					next = append(next, field{name: ft.Name(), index: index, typ: ft})
+				}
+			}
+		}
+	}
+
+	// Sort by name, breaking ties with depth, then whether the name came from
+	// a tag, then index sequence.
+	slices.SortFunc(fields, func(a, b field) int {
+		if c := strings.Compare(a.name, b.name); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(len(a.index), len(b.index)); c != 0 {
+			return c
+		}
+		if a.tagged != b.tagged {
+			if a.tagged {
+				return -1
+			}
+			return 1
+		}
+		return slices.Compare(a.index, b.index)
+	})
+
+	// Delete all fields that are hidden by the Go rules for embedded fields,
+	// except that fields with tags are promoted.
+	out := fields[:0]
+	for advance, i := 0, 0; i < len(fields); i += advance {
+		// One iteration per name. Find the sequence of fields with this name.
+		fi := fields[i]
+		for advance = 1; i+advance < len(fields); advance++ {
+			if fields[i+advance].name != fi.name {
+				break
+			}
+		}
+		if dominant, ok := dominantField(fields[i : i+advance]); ok {
+			out = append(out, dominant)
+		}
+	}
+	fields = out
+
+	// Back to declaration order.
+	slices.SortFunc(fields, func(a, b field) int {
+		return slices.Compare(a.index, b.index)
+	})
+
+	return fields
+}
+
+// dominantField looks through the fields, all of which are known to have the
+// same name, to find the single field that dominates the others. Fields are
+// sorted by depth and taggedness, so only the first two need checking.
+func dominantField(fields []field) (field, bool) {
+	if len(fields) > 1 && len(fields[0].index) == len(fields[1].index) && fields[0].tagged == fields[1].tagged {
+		return field{}, false
+	}
+	return fields[0], true
+}
+
+func newField(name string, tagged bool, index []int, typ reflect.Type, opts tagOptions) field {
+	f := field{
+		name:      name,
+		tagged:    tagged,
+		index:     index,
+		typ:       typ,
+		omitEmpty: opts.Contains("omitempty"),
+		omitZero:  opts.Contains("omitzero"),
+		quoted:    opts.Contains("string") && quotable(typ),
+	}
+
+	// Integer keys are a common compact schema convention, e.g.
+	//   Name string `msgpack:"1,keyasint"`
+	// Names that don't parse as integers are left as strings.
+	if opts.Contains("keyasint") {
+		if n, err := strconv.ParseInt(name, 10, 64); err == nil {
+			f.keyAsInt = true
+			f.intKey = n
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	e := &encodeState{writer: buf, encodeOptions: encodeOptions{canonical: true}}
+	if f.keyAsInt {
+		marshalInt(reflect.ValueOf(f.intKey), e)
+	} else {
+		marshalString(reflect.ValueOf(name), e)
+	}
+	f.key = buf.Bytes()
+
+	return f
+}
+
+// quotable reports whether the string option applies to a field of type t.
+// Like encoding/json, it's only honored for booleans, numbers and strings, or
+// pointers to them, and ignored for other types.
+func quotable(t reflect.Type) bool {
+	if t.Name() == "" && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64,
+		reflect.String:
+		return true
+	}
+	return false
+}
+
+// fieldTag returns the msgpack tag of the field, falling back to the
+// encoding/json tag, including its options, so structs already annotated for
+// JSON don't have to be tagged again.
+func fieldTag(f reflect.StructField) string {
+	tag := f.Tag.Get("msgpack")
+	if tag == "" {
+		tag = f.Tag.Get("json")
+	}
+	return tag
+}
+
+// fieldByIndex returns the nested field of rv at the index sequence. It
+// reports false if the field is unreachable because an embedded struct
+// pointer along the way is nil.
+func fieldByIndex(rv reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && rv.Kind() == reflect.Pointer {
+			if rv.IsNil() {
+				return reflect.Value{}, false
+			}
+			rv = rv.Elem()
+		}
+		rv = rv.Field(x)
+	}
+	return rv, true
+}
+
+// fieldByIndexAlloc is like fieldByIndex but allocates any nil embedded
+// struct pointers along the way so the field can be set.
+func fieldByIndexAlloc(rv reflect.Value, index []int) (reflect.Value, error) {
+	for i, x := range index {
+		if i > 0 && rv.Kind() == reflect.Pointer {
+			if rv.IsNil() {
+				if !rv.CanSet() {
+					return reflect.Value{}, fmt.Errorf("msgpack: cannot set embedded pointer to unexported struct: %v", rv.Type().Elem())
+				}
+				rv.Set(reflect.New(rv.Type().Elem()))
+			}
+			rv = rv.Elem()
+		}
+		rv = rv.Field(x)
+	}
+	return rv, nil
+}
+
+// tagOptions is the comma separated list of options following the name in a
+// struct tag, e.g. "omitempty,string" in `msgpack:"foo,omitempty,string"`.
+type tagOptions string
+
+func parseTag(tag string) (string, tagOptions) {
+	name, opts, _ := strings.Cut(tag, ",")
+	return name, tagOptions(opts)
+}
+
+// Contains reports whether the option list contains the option name.
+func (o tagOptions) Contains(name string) bool {
+	s := string(o)
+	for s != "" {
+		var opt string
+		opt, s, _ = strings.Cut(s, ",")
+		if opt == name {
+			return true
+		}
+	}
+	return false
+}
@@ -184,11 +184,11 @@ func TestUnmarshalFloatIntoWrongType(t *testing.T) {
 	data := msgpack.MustMarshal(float64(3.14))
 
 	err := msgpack.Unmarshal(data, &i)
-	assert.EqualError(t, err, "msgpack: cannot unmarshal float into Go type of int64")
+	assert.EqualError(t, err, "msgpack: cannot unmarshal float into Go value of type int64")
 
 	v = &i
 	err = msgpack.Unmarshal(data, &v)
-	assert.EqualError(t, err, "msgpack: cannot unmarshal float into Go type of int64")
+	assert.EqualError(t, err, "msgpack: cannot unmarshal float into Go value of type int64")
 
 	v = i
 	err = msgpack.Unmarshal(data, &v)
@@ -0,0 +1,128 @@
+package msgpack
+
+import (
+	"fmt"
+	"io"
+)
+
+// Limits bound the resources used to decode a single value, protecting
+// against malicious or corrupt input such as a few bytes of header claiming a
+// multi-gigabyte string. A zero field means no limit.
+//
+// Limits are enforced as soon as a header is read, before anything is
+// allocated for it. Input that isn't fully in memory can't be checked against
+// the lengths in its headers, so it is read in bounded chunks and memory only
+// grows as the data actually arrives.
+type Limits struct {
+	MaxStringLen int   // bytes in a str
+	MaxBinLen    int   // bytes in a bin
+	MaxExtLen    int   // bytes in an ext's data
+	MaxArrayLen  int   // elements in an array
+	MaxMapLen    int   // key/value pairs in a map
+	MaxDepth     int   // nesting of arrays and maps
+	MaxAlloc     int64 // total bytes allocated for strings, bins, exts, arrays and maps
+}
+
+// DefaultLimits are the limits used by Unmarshal and by new Decoders. Only the
+// nesting depth is limited, to keep deeply nested input from exhausting the
+// stack.
+var DefaultLimits = Limits{
+	MaxDepth: 10000,
+}
+
+// A LimitError is returned when decoding input that exceeds one of the
+// configured Limits.
+type LimitError struct {
+	Limit string // name of the Limits field that was exceeded
+	Value int64  // the size that was requested
+	Max   int64  // the configured maximum
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("msgpack: %s exceeded: %d > %d", e.Limit, e.Value, e.Max)
+}
+
+// checkLen is called with the length of a str, bin or ext before its data is
+// read.
+func (d *decodeState) checkLen(limit string, length uint32, max int) error {
+	if err := d.checkSize(limit, length, max); err != nil {
+		return err
+	}
+	return d.alloc(int64(length))
+}
+
+// checkSize is like checkLen for data that is skipped, or read into a reused
+// buffer, so doesn't count towards MaxAlloc.
+func (d *decodeState) checkSize(limit string, length uint32, max int) error {
+	if max > 0 && int64(length) > int64(max) {
+		return &LimitError{Limit: limit, Value: int64(length), Max: int64(max)}
+	}
+	return d.checkRemaining(int64(length))
+}
+
+// checkCount is called with the number of elements in an array or map, and
+// the number of bytes each occupies once decoded, before it is allocated.
+func (d *decodeState) checkCount(limit string, count uint32, max int, size uintptr) error {
+	if max > 0 && int64(count) > int64(max) {
+		return &LimitError{Limit: limit, Value: int64(count), Max: int64(max)}
+	}
+
+	// Every element takes up at least one byte.
+	if err := d.checkRemaining(int64(count)); err != nil {
+		return err
+	}
+
+	return d.alloc(int64(count) * int64(size))
+}
+
+// readChunk is the most that is allocated ahead of the input arriving, when
+// its length isn't known.
+const readChunk = 64 << 10
+
+// checkRemaining makes sure that n bytes are still available, if the input
+// is fully in memory and this can be known up front.
+func (d *decodeState) checkRemaining(n int64) error {
+	if r, ok := d.byteReader.(interface{ Len() int }); ok && n > int64(r.Len()) {
+		return fmt.Errorf("msgpack: length %d exceeds remaining input: %w", n, io.ErrUnexpectedEOF)
+	}
+	return nil
+}
+
+// sized reports whether the input is fully in memory, so that lengths read
+// from headers have been checked against what remains of it.
+func (d *decodeState) sized() bool {
+	_, ok := d.byteReader.(interface{ Len() int })
+	return ok
+}
+
+// prealloc returns how many of count elements, each taking size bytes, to
+// allocate before decoding them. Otherwise the count in a header could make
+// the decoder allocate far more than the input it was actually sent.
+func (d *decodeState) prealloc(count uint32, size uintptr) int {
+	if d.sized() || size == 0 {
+		return int(count)
+	}
+	return min(int(count), max(1, readChunk/int(size)))
+}
+
+func (d *decodeState) alloc(n int64) error {
+	d.allocated += n
+	if max := d.limits.MaxAlloc; max > 0 && d.allocated > max {
+		return &LimitError{Limit: "MaxAlloc", Value: d.allocated, Max: max}
+	}
+	return nil
+}
+
+// enter is called when descending into an array or map, and must be paired
+// with a call to leave.
+func (d *decodeState) enter() error {
+	d.depth++
+	if max := d.limits.MaxDepth; max > 0 && d.depth > max {
+		return &LimitError{Limit: "MaxDepth", Value: int64(d.depth), Max: int64(max)}
+	}
+	return nil
+}
+
+func (d *decodeState) leave() {
+	d.depth--
+}
@@ -0,0 +1,176 @@
+package msgpack_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	msgpack "github.com/cjbottaro/msgpack_go"
+	"github.com/stretchr/testify/require"
+)
+
+func requireLimitError(t *testing.T, err error, limit string) {
+	t.Helper()
+	var le *msgpack.LimitError
+	require.True(t, errors.As(err, &le), "expected LimitError, got %v", err)
+	require.Equal(t, limit, le.Limit)
+}
+
+func TestUnmarshalHugeLengths(t *testing.T) {
+	// Each of these headers claims gigabytes of data that isn't there. They
+	// must fail before anything is allocated.
+	inputs := map[string][]byte{
+		"str32":   {0xdb, 0xff, 0xff, 0xff, 0xff},
+		"bin32":   {0xc6, 0xff, 0xff, 0xff, 0xff},
+		"array32": {0xdd, 0xff, 0xff, 0xff, 0xff},
+		"map32":   {0xdf, 0xff, 0xff, 0xff, 0xff},
+		"ext32":   {0xc9, 0xff, 0xff, 0xff, 0xff, 0x01},
+	}
+
+	for name, data := range inputs {
+		t.Run(name, func(t *testing.T) {
+			var v any
+			if name == "bin32" {
+				v = &[]byte{}
+			}
+			err := msgpack.Unmarshal(data, &v)
+			require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		})
+	}
+}
+
+func TestDecoderHugeLengths(t *testing.T) {
+	// A stream's length isn't known up front, so the headers can't be
+	// rejected right away. Memory must only grow as real bytes arrive.
+	str32 := []byte{0xdb, 0x7f, 0xff, 0xff, 0xff, 'a', 'b'}
+	bin32 := []byte{0xc6, 0x7f, 0xff, 0xff, 0xff, 0x01}
+	array32 := []byte{0xdd, 0x0f, 0xff, 0xff, 0xff, 0x01, 0x02}
+	map32 := []byte{0xdf, 0x0f, 0xff, 0xff, 0xff, 0xa1, 'a', 0x01}
+	ext32 := []byte{0xc9, 0x7f, 0xff, 0xff, 0xff, 0x01, 0x02}
+
+	tests := []struct {
+		name   string
+		data   []byte
+		target any
+	}{
+		{"str32", str32, new(any)},
+		{"str32 string", str32, new(string)},
+		{"bin32", bin32, new(any)},
+		{"bin32 bytes", bin32, new([]byte)},
+		{"array32", array32, new(any)},
+		{"array32 ints", array32, new([]int)},
+		{"map32", map32, new(any)},
+		{"map32 map", map32, new(map[string]int)},
+		{"ext32", ext32, new(any)},
+		{"ext32 raw", ext32, new(msgpack.RawExt)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, w := io.Pipe()
+			go func() {
+				w.Write(tt.data)
+				w.Close()
+			}()
+
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			err := msgpack.NewDecoder(r).Decode(tt.target)
+			runtime.ReadMemStats(&after)
+
+			require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+			require.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<20))
+		})
+	}
+}
+
+func TestDecoderStreamLargeValues(t *testing.T) {
+	// Values larger than a read chunk still decode from a stream.
+	in := []any{strings.Repeat("x", 200000), []byte(strings.Repeat("y", 300000)), make([]any, 100000)}
+	for i := range in[2].([]any) {
+		in[2].([]any)[i] = int64(i)
+	}
+
+	var out any
+	require.NoError(t, msgpack.NewDecoder(io.MultiReader(bytes.NewReader(msgpack.MustMarshal(in)))).Decode(&out))
+	require.Equal(t, in, out)
+}
+
+func TestDecoderLimits(t *testing.T) {
+	decode := func(limits msgpack.Limits, v any) error {
+		dec := msgpack.NewDecoder(bytes.NewReader(msgpack.MustMarshal(v)))
+		dec.SetLimits(limits)
+		out := reflect.New(reflect.TypeOf(v))
+		return dec.Decode(out.Interface())
+	}
+
+	err := decode(msgpack.Limits{MaxStringLen: 3}, "abcd")
+	requireLimitError(t, err, "MaxStringLen")
+	require.NoError(t, decode(msgpack.Limits{MaxStringLen: 3}, "abc"))
+
+	err = decode(msgpack.Limits{MaxBinLen: 3}, []byte("abcd"))
+	requireLimitError(t, err, "MaxBinLen")
+
+	err = decode(msgpack.Limits{MaxArrayLen: 2}, []int{1, 2, 3})
+	requireLimitError(t, err, "MaxArrayLen")
+
+	err = decode(msgpack.Limits{MaxMapLen: 1}, map[string]int{"a": 1, "b": 2})
+	requireLimitError(t, err, "MaxMapLen")
+
+	err = decode(msgpack.Limits{MaxDepth: 2}, []any{[]any{[]any{}}})
+	requireLimitError(t, err, "MaxDepth")
+	require.NoError(t, decode(msgpack.Limits{MaxDepth: 3}, []any{[]any{[]any{}}}))
+
+	err = decode(msgpack.Limits{MaxAlloc: 100}, []string{strings.Repeat("a", 60), strings.Repeat("b", 60)})
+	requireLimitError(t, err, "MaxAlloc")
+}
+
+func TestDecoderLimitsStruct(t *testing.T) {
+	type S struct {
+		Name string `msgpack:"name"`
+	}
+
+	dec := msgpack.NewDecoder(bytes.NewReader(msgpack.MustMarshal(map[string]any{
+		"name":    "foo",
+		"unknown": strings.Repeat("a", 100),
+	})))
+	dec.SetLimits(msgpack.Limits{MaxStringLen: 10})
+
+	var s S
+	requireLimitError(t, dec.Decode(&s), "MaxStringLen")
+}
+
+func TestDecoderMaxAllocSkipped(t *testing.T) {
+	type S struct {
+		N int `msgpack:"n"`
+	}
+
+	data := msgpack.MustMarshal(map[string]any{
+		"n":                      1,
+		"unknown":                strings.Repeat("a", 1000),
+		strings.Repeat("k", 600): 2,
+	})
+
+	// Skipped values and struct keys aren't kept, so they don't count.
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetLimits(msgpack.Limits{MaxAlloc: 500})
+
+	var s S
+	require.NoError(t, dec.Decode(&s))
+	require.Equal(t, 1, s.N)
+
+	dec = msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetLimits(msgpack.Limits{MaxAlloc: 500})
+	require.NoError(t, dec.Skip())
+
+	// Raw values are kept.
+	dec = msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetLimits(msgpack.Limits{MaxAlloc: 500})
+
+	var raw msgpack.RawMessage
+	requireLimitError(t, dec.Decode(&raw), "MaxAlloc")
+}
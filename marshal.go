@@ -2,246 +2,415 @@ package msgpack
 
 import (
 	"bytes"
+	"encoding"
 	"encoding/binary"
+	"fmt"
+	"io"
 	"reflect"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
 )
 
-func marshalAny(rv reflect.Value, buf *bytes.Buffer) (err error) {
-	switch rv.Kind() {
-	case reflect.Pointer:
+// writer is the sink that the marshal functions write to. Both *bytes.Buffer
+// and *bufio.Writer satisfy it.
+type writer interface {
+	io.Writer
+	io.ByteWriter
+	io.StringWriter
+}
+
+// encodeState is threaded through the marshal functions and carries the
+// destination along with the options that control encoding.
+type encodeState struct {
+	writer
+	encodeOptions
+}
+
+type encodeOptions struct {
+	preferStdMarshalers bool
+	structAsArray       bool
+	canonical           bool
+	nilAsEmpty          bool
+	exts                *ExtRegistry
+}
+
+func marshalAny(rv reflect.Value, e *encodeState) (err error) {
+	if !rv.IsValid() {
+		return marshalNil(rv, e) // nil any
+	}
+
+	for rv.Kind() == reflect.Pointer || rv.Kind() == reflect.Interface {
 		if rv.IsNil() {
-			return marshalNil(rv, buf)
+			return marshalNil(rv, e)
 		}
 		rv = rv.Elem()
-	case reflect.Interface:
-		rv = rv.Elem()
 	}
 
-	if handler, found := _extRegistryByType[rv.Type()]; found {
-		return marshalExt(rv, handler, buf)
+	ti := cachedTypeInfo(rv.Type())
+
+	if m, ok := ti.marshaler.value(rv); ok {
+		return marshalMarshaler(m, e)
+	}
+
+	if ti.rawExt {
+		return marshalRawExt(rv, e)
+	}
+
+	var handler extHandler
+	var isExt bool
+	if ti.ext.Load() {
+		handler, isExt = e.exts.byType(rv.Type())
+	}
+	if !e.preferStdMarshalers {
+		if isExt {
+			return marshalExt(rv, handler, e)
+		}
+		if ti.time {
+			return marshalTime(rv, e)
+		}
+	}
+
+	if m, ok := ti.textMarshaler.value(rv); ok {
+		return marshalTextMarshaler(m, e)
+	}
+
+	if m, ok := ti.binaryMarshaler.value(rv); ok {
+		return marshalBinaryMarshaler(m, e)
+	}
+
+	if isExt {
+		return marshalExt(rv, handler, e)
 	}
 
 	switch rv.Kind() {
 	case reflect.Bool:
-		err = marshalBool(rv, buf)
+		err = marshalBool(rv, e)
 	case reflect.String:
-		err = marshalString(rv, buf)
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		err = marshalUint(rv, buf)
+		err = marshalString(rv, e)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		err = marshalUint(rv, e)
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		err = marshalInt(rv, buf)
+		err = marshalInt(rv, e)
 	case reflect.Float32, reflect.Float64:
-		err = marshalFloat(rv, buf)
+		err = marshalFloat(rv, e)
 	case reflect.Slice:
+		if rv.IsNil() && !e.nilAsEmpty {
+			err = marshalNil(rv, e)
+		} else if rv.Type().Elem().Kind() == reflect.Uint8 {
+			err = marshalBinary(rv, e)
+		} else {
+			err = marshalArray(rv, e)
+		}
+	case reflect.Array:
 		if rv.Type().Elem().Kind() == reflect.Uint8 {
-			err = marshalBinary(rv, buf)
+			err = marshalByteArray(rv, e)
 		} else {
-			err = marshalArray(rv, buf)
+			err = marshalArray(rv, e)
 		}
 	case reflect.Map:
-		err = marshalMap(rv, buf)
+		if rv.IsNil() && !e.nilAsEmpty {
+			err = marshalNil(rv, e)
+		} else {
+			err = marshalMap(rv, e)
+		}
 	case reflect.Struct:
-		err = marshalStruct(rv, buf)
+		err = marshalStruct(rv, e)
+	default:
+		err = &UnsupportedTypeError{Type: rv.Type()}
 	}
 
 	return err
 }
 
-func marshalNil(_ reflect.Value, buf *bytes.Buffer) error {
-	return buf.WriteByte(0xc0)
+func marshalNil(_ reflect.Value, e *encodeState) error {
+	return e.WriteByte(0xc0)
 }
 
-func marshalExt(rv reflect.Value, handler extHandler, buf *bytes.Buffer) error {
+func marshalMarshaler(rv reflect.Value, e *encodeState) error {
+	data, err := rv.Interface().(Marshaler).MarshalMsgpack()
+	if err != nil {
+		return fmt.Errorf("msgpack: error calling MarshalMsgpack for type %v: %w", rv.Type(), err)
+	}
+
+	// Make sure the output is exactly one value, otherwise the surrounding
+	// document would be corrupted.
+	reader := bytes.NewReader(data)
+	b, err := reader.ReadByte()
+	if err == nil {
+		err = skipValue(b, newDecodeState(reader, decodeOptions{limits: DefaultLimits}))
+	}
+	if err != nil || reader.Len() != 0 {
+		return fmt.Errorf("msgpack: MarshalMsgpack for type %v returned invalid msgpack", rv.Type())
+	}
+
+	_, err = e.Write(data)
+	return err
+}
+
+func marshalTextMarshaler(rv reflect.Value, e *encodeState) error {
+	text, err := rv.Interface().(encoding.TextMarshaler).MarshalText()
+	if err != nil {
+		return fmt.Errorf("msgpack: error calling MarshalText for type %v: %w", rv.Type(), err)
+	}
+
+	marshalStringHeader(len(text), e)
+	_, err = e.Write(text)
+	return err
+}
+
+func marshalBinaryMarshaler(rv reflect.Value, e *encodeState) error {
+	data, err := rv.Interface().(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("msgpack: error calling MarshalBinary for type %v: %w", rv.Type(), err)
+	}
+
+	marshalBinaryHeader(len(data), e)
+	_, err = e.Write(data)
+	return err
+}
+
+func marshalExt(rv reflect.Value, handler extHandler, e *encodeState) error {
+	if handler.encodeFn != nil {
+		return marshalNestedExt(rv, handler, e)
+	}
+
 	// Use the custom marshal function to get the data
 	data, err := handler.marshalFn(rv.Interface())
 	if err != nil {
 		return err
 	}
 
-	length := len(data)
+	marshalExtHeader(len(data), handler.typeId, e)
+
+	// Write the serialized data
+	_, err = e.Write(data)
+	return err
+}
+
+// marshalNestedExt encodes an ext registered with RegisterNestedExtIn, whose
+// data is written with the encoder's own settings.
+func marshalNestedExt(rv reflect.Value, handler extHandler, e *encodeState) error {
+	var buf bytes.Buffer
+	enc := &Encoder{w: &buf, opts: e.encodeOptions, nested: true}
+	if err := handler.encodeFn(enc, rv.Interface()); err != nil {
+		return err
+	}
+
+	marshalExtHeader(buf.Len(), handler.typeId, e)
+	_, err := e.Write(buf.Bytes())
+	return err
+}
+
+func marshalRawExt(rv reflect.Value, e *encodeState) error {
+	ext := rv.Interface().(RawExt)
+	marshalExtHeader(len(ext.Data), ext.Type, e)
+	_, err := e.Write(ext.Data)
+	return err
+}
+
+func marshalExtHeader(length int, typeId int8, e *encodeState) {
 
 	// Write ext header
 	switch {
 	case length == 1: // fixext1
-		buf.WriteByte(0xd4)
+		e.WriteByte(0xd4)
 	case length == 2: // fixext2
-		buf.WriteByte(0xd5)
+		e.WriteByte(0xd5)
 	case length == 4: // fixext4
-		buf.WriteByte(0xd6)
+		e.WriteByte(0xd6)
 	case length == 8: // fixext8
-		buf.WriteByte(0xd7)
+		e.WriteByte(0xd7)
 	case length == 16: // fixext16
-		buf.WriteByte(0xd8)
+		e.WriteByte(0xd8)
 	case length <= 255: // ext8
-		buf.WriteByte(0xc7)
-		binary.Write(buf, binary.BigEndian, uint8(length))
+		e.WriteByte(0xc7)
+		binary.Write(e, binary.BigEndian, uint8(length))
 	case length <= 65535: // ext16
-		buf.WriteByte(0xc8)
-		binary.Write(buf, binary.BigEndian, uint16(length))
+		e.WriteByte(0xc8)
+		binary.Write(e, binary.BigEndian, uint16(length))
 	default: // ext32
-		buf.WriteByte(0xc9)
-		binary.Write(buf, binary.BigEndian, uint32(length))
+		e.WriteByte(0xc9)
+		binary.Write(e, binary.BigEndian, uint32(length))
 	}
 
 	// Write type identifier
-	buf.WriteByte(byte(handler.typeId))
-
-	// Write the serialized data
-	_, err = buf.Write(data)
-	return err
+	e.WriteByte(byte(typeId))
 }
 
-func marshalBool(rv reflect.Value, buf *bytes.Buffer) error {
+func marshalBool(rv reflect.Value, e *encodeState) error {
 	if rv.Bool() {
-		return buf.WriteByte(0xc3) // true
+		return e.WriteByte(0xc3) // true
 	}
-	return buf.WriteByte(0xc2) // false
+	return e.WriteByte(0xc2) // false
 }
 
-func marshalUint(rv reflect.Value, buf *bytes.Buffer) error {
-	v := rv.Uint()
+func marshalUint(rv reflect.Value, e *encodeState) error {
+	marshalUint64(rv.Uint(), e)
+	return nil
+}
 
+func marshalUint64(v uint64, e *encodeState) {
 	switch {
 	case v <= 127: // Positive fixint
-		buf.WriteByte(uint8(v))
+		e.WriteByte(uint8(v))
 	case v <= 255: // uint8
-		buf.WriteByte(0xcc)
-		binary.Write(buf, binary.BigEndian, uint8(v))
+		e.WriteByte(0xcc)
+		binary.Write(e, binary.BigEndian, uint8(v))
 	case v <= 65535: // uint16
-		buf.WriteByte(0xcd)
-		binary.Write(buf, binary.BigEndian, uint16(v))
+		e.WriteByte(0xcd)
+		binary.Write(e, binary.BigEndian, uint16(v))
 	case v <= 4294967295: // uint32
-		buf.WriteByte(0xce)
-		binary.Write(buf, binary.BigEndian, uint32(v))
+		e.WriteByte(0xce)
+		binary.Write(e, binary.BigEndian, uint32(v))
 	default: // uint64
-		buf.WriteByte(0xcf)
-		binary.Write(buf, binary.BigEndian, uint64(v))
+		e.WriteByte(0xcf)
+		binary.Write(e, binary.BigEndian, uint64(v))
 	}
+}
 
+func marshalInt(rv reflect.Value, e *encodeState) error {
+	marshalInt64(rv.Int(), e)
 	return nil
 }
 
-func marshalInt(rv reflect.Value, buf *bytes.Buffer) error {
-	v := rv.Int()
+func marshalInt64(v int64, e *encodeState) {
+	// Canonical output doesn't depend on the signedness of the Go type, so
+	// non-negative values always use the smallest unsigned format.
+	if e.canonical && v >= 0 {
+		marshalUint64(uint64(v), e)
+		return
+	}
 
 	switch {
 	case v >= -32 && v <= -1: // Negative fixint
-		buf.WriteByte(uint8((v & 0b00011111) | 0b11100000))
+		e.WriteByte(uint8((v & 0b00011111) | 0b11100000))
 	case v >= 0 && v <= 127: // Positive fixint
-		buf.WriteByte(uint8(v))
+		e.WriteByte(uint8(v))
 	case v >= -128 && v <= 127: // int8
-		buf.WriteByte(0xd0)
-		binary.Write(buf, binary.BigEndian, int8(v))
+		e.WriteByte(0xd0)
+		binary.Write(e, binary.BigEndian, int8(v))
 	case v >= -32768 && v <= 32767: // int16
-		buf.WriteByte(0xd1)
-		binary.Write(buf, binary.BigEndian, int16(v))
+		e.WriteByte(0xd1)
+		binary.Write(e, binary.BigEndian, int16(v))
 	case v >= -2147483648 && v <= 2147483647: // int32
-		buf.WriteByte(0xd2)
-		binary.Write(buf, binary.BigEndian, int32(v))
+		e.WriteByte(0xd2)
+		binary.Write(e, binary.BigEndian, int32(v))
 	default: // int64
-		buf.WriteByte(0xd3)
-		binary.Write(buf, binary.BigEndian, int64(v))
+		e.WriteByte(0xd3)
+		binary.Write(e, binary.BigEndian, int64(v))
 	}
-
-	return nil
 }
 
-func marshalFloat(rv reflect.Value, buf *bytes.Buffer) error {
+func marshalFloat(rv reflect.Value, e *encodeState) error {
 	v := rv.Float()
 
 	if rv.Kind() == reflect.Float32 {
-		buf.WriteByte(0xca) // float32
-		binary.Write(buf, binary.BigEndian, float32(v))
+		e.WriteByte(0xca) // float32
+		binary.Write(e, binary.BigEndian, float32(v))
 	} else {
-		buf.WriteByte(0xcb) // float64
-		binary.Write(buf, binary.BigEndian, float64(v))
+		e.WriteByte(0xcb) // float64
+		binary.Write(e, binary.BigEndian, float64(v))
 	}
 
 	return nil
 }
 
-func marshalString(rv reflect.Value, buf *bytes.Buffer) error {
+func marshalString(rv reflect.Value, e *encodeState) error {
 	str := rv.String()
-	length := len(str)
+	marshalStringHeader(len(str), e)
+	_, err := e.WriteString(str)
+	return err
+}
 
+func marshalStringHeader(length int, e *encodeState) {
 	switch {
 	case length <= 31: // fixstr
-		buf.WriteByte(0xa0 | uint8(length))
+		e.WriteByte(0xa0 | uint8(length))
 	case length <= 255: // str8
-		buf.WriteByte(0xd9)
-		binary.Write(buf, binary.BigEndian, uint8(length))
+		e.WriteByte(0xd9)
+		binary.Write(e, binary.BigEndian, uint8(length))
 	case length <= 65535: // str16
-		buf.WriteByte(0xda)
-		binary.Write(buf, binary.BigEndian, uint16(length))
+		e.WriteByte(0xda)
+		binary.Write(e, binary.BigEndian, uint16(length))
 	default: // str32
-		buf.WriteByte(0xdb)
-		binary.Write(buf, binary.BigEndian, uint32(length))
+		e.WriteByte(0xdb)
+		binary.Write(e, binary.BigEndian, uint32(length))
 	}
+}
 
-	_, err := buf.WriteString(str)
+func marshalBinary(rv reflect.Value, e *encodeState) error {
+	data := rv.Bytes()
+	marshalBinaryHeader(len(data), e)
+	_, err := e.Write(data)
 	return err
 }
 
-func marshalBinary(rv reflect.Value, buf *bytes.Buffer) error {
-	data := rv.Bytes()
-	length := len(data)
+// marshalByteArray writes a [N]byte as bin, so fixed size values like hashes
+// and UUIDs encode the same as their slices would.
+func marshalByteArray(rv reflect.Value, e *encodeState) error {
+	marshalBinaryHeader(rv.Len(), e)
+
+	if rv.CanAddr() {
+		_, err := e.Write(rv.Bytes())
+		return err
+	}
 
+	data := make([]byte, rv.Len())
+	reflect.Copy(reflect.ValueOf(data), rv)
+	_, err := e.Write(data)
+	return err
+}
+
+func marshalBinaryHeader(length int, e *encodeState) {
 	switch {
 	case length <= 255: // bin8
-		buf.WriteByte(0xc4)
-		binary.Write(buf, binary.BigEndian, uint8(length))
+		e.WriteByte(0xc4)
+		binary.Write(e, binary.BigEndian, uint8(length))
 	case length <= 65535: // bin16
-		buf.WriteByte(0xc5)
-		binary.Write(buf, binary.BigEndian, uint16(length))
+		e.WriteByte(0xc5)
+		binary.Write(e, binary.BigEndian, uint16(length))
 	default: // bin32
-		buf.WriteByte(0xc6)
-		binary.Write(buf, binary.BigEndian, uint32(length))
+		e.WriteByte(0xc6)
+		binary.Write(e, binary.BigEndian, uint32(length))
 	}
-
-	_, err := buf.Write(data)
-	return err
 }
 
-func marshalArray(rv reflect.Value, buf *bytes.Buffer) error {
+func marshalArray(rv reflect.Value, e *encodeState) error {
 	length := rv.Len()
-
-	// Write the array header
-	switch {
-	case length <= 15: // fixarray
-		buf.WriteByte(0x90 | uint8(length))
-	case length <= 65535: // array16
-		buf.WriteByte(0xdc)
-		binary.Write(buf, binary.BigEndian, uint16(length))
-	default: // array32
-		buf.WriteByte(0xdd)
-		binary.Write(buf, binary.BigEndian, uint32(length))
-	}
+	marshalArrayHeader(length, e)
 
 	// Marshal each element
 	for i := 0; i < length; i++ {
 		elem := rv.Index(i)
-		if err := marshalAny(elem, buf); err != nil {
-			return err
+		if err := marshalAny(elem, e); err != nil {
+			return withPath(err, pathElem{index: i})
 		}
 	}
 
 	return nil
 }
 
-func marshalMap(rv reflect.Value, buf *bytes.Buffer) error {
-	length := rv.Len()
-
-	// Write the map header
+func marshalArrayHeader(length int, e *encodeState) {
 	switch {
-	case length <= 15: // fixmap
-		buf.WriteByte(0x80 | uint8(length))
-	case length <= 65535: // map16
-		buf.WriteByte(0xde)
-		binary.Write(buf, binary.BigEndian, uint16(length))
-	default: // map32
-		buf.WriteByte(0xdf)
-		binary.Write(buf, binary.BigEndian, uint32(length))
+	case length <= 15: // fixarray
+		e.WriteByte(0x90 | uint8(length))
+	case length <= 65535: // array16
+		e.WriteByte(0xdc)
+		binary.Write(e, binary.BigEndian, uint16(length))
+	default: // array32
+		e.WriteByte(0xdd)
+		binary.Write(e, binary.BigEndian, uint32(length))
 	}
+}
+
+func marshalMap(rv reflect.Value, e *encodeState) error {
+	if e.canonical {
+		return marshalMapCanonical(rv, e)
+	}
+
+	marshalMapHeader(rv.Len(), e)
 
 	// Marshal each key-value pair
 	iter := rv.MapRange()
@@ -250,64 +419,305 @@ func marshalMap(rv reflect.Value, buf *bytes.Buffer) error {
 		value := iter.Value()
 
 		// Marshal key
-		if err := marshalAny(key, buf); err != nil {
+		if err := marshalAny(key, e); err != nil {
 			return err
 		}
 
 		// Marshal value
-		if err := marshalAny(value, buf); err != nil {
-			return err
+		if err := marshalAny(value, e); err != nil {
+			return withPath(err, pathElem{key: key})
 		}
 	}
 
 	return nil
 }
 
-func marshalStruct(rv reflect.Value, buf *bytes.Buffer) error {
-	rt := rv.Type()
-	length := 0
+// marshalMapCanonical writes the map's entries sorted by the encoded bytes of
+// their keys, so equal maps always produce the same output.
+func marshalMapCanonical(rv reflect.Value, e *encodeState) error {
+	type entry struct {
+		key        []byte
+		start, end int // position of key in buf
+		keyValue   reflect.Value
+		value      reflect.Value
+	}
 
-	// Count fields that should be serialized
-	for i := 0; i < rt.NumField(); i++ {
-		field := rt.Field(i)
-		if structFieldName(field) != "" {
-			length++
+	entries := make([]entry, 0, rv.Len())
+	buf := new(bytes.Buffer)
+	ke := &encodeState{writer: buf, encodeOptions: e.encodeOptions}
+
+	// Encode all the keys into one buffer first, then slice it up once it's
+	// done growing.
+	iter := rv.MapRange()
+	for iter.Next() {
+		start := buf.Len()
+		if err := marshalAny(iter.Key(), ke); err != nil {
+			return err
+		}
+		entries = append(entries, entry{start: start, end: buf.Len(), keyValue: iter.Key(), value: iter.Value()})
+	}
+
+	for i := range entries {
+		entries[i].key = buf.Bytes()[entries[i].start:entries[i].end]
+	}
+
+	slices.SortFunc(entries, func(a, b entry) int {
+		return bytes.Compare(a.key, b.key)
+	})
+
+	// Keys of different Go types can encode the same, like int8(1) and
+	// uint64(1), which would leave duplicates in the output.
+	for i := 1; i < len(entries); i++ {
+		if bytes.Equal(entries[i-1].key, entries[i].key) {
+			return &duplicateKeyError{path: valuePath{{key: entries[i].keyValue}}}
+		}
+	}
+
+	marshalMapHeader(len(entries), e)
+
+	for _, entry := range entries {
+		if _, err := e.Write(entry.key); err != nil {
+			return err
+		}
+		if err := marshalAny(entry.value, e); err != nil {
+			return withPath(err, pathElem{key: entry.keyValue})
 		}
 	}
 
-	// Write the map header
+	return nil
+}
+
+func marshalMapHeader(length int, e *encodeState) {
 	switch {
 	case length <= 15: // fixmap
-		buf.WriteByte(0x80 | uint8(length))
+		e.WriteByte(0x80 | uint8(length))
 	case length <= 65535: // map16
-		buf.WriteByte(0xde)
-		binary.Write(buf, binary.BigEndian, uint16(length))
+		e.WriteByte(0xde)
+		binary.Write(e, binary.BigEndian, uint16(length))
 	default: // map32
-		buf.WriteByte(0xdf)
-		binary.Write(buf, binary.BigEndian, uint32(length))
+		e.WriteByte(0xdf)
+		binary.Write(e, binary.BigEndian, uint32(length))
 	}
+}
 
-	// Yes, we're iterating twice and calling structFieldName twice for each
-	// field, but we avoid allocations this way.
+func marshalStruct(rv reflect.Value, e *encodeState) error {
+	sf := cachedTypeFields(rv.Type())
+	if sf.asArray || e.structAsArray {
+		return marshalStructAsArray(rv, sf.list, e)
+	}
 
-	for i := 0; i < rt.NumField(); i++ {
-		field := rt.Field(i)
-		fieldName := structFieldName(field)
-		if fieldName == "" {
-			continue // Skip fields without a valid name
+	fields := sf.list
+	if e.canonical {
+		fields = sf.sorted
+	}
+	length := 0
+
+	// Count fields that should be serialized
+	for i := range fields {
+		fv, ok := fieldByIndex(rv, fields[i].index)
+		if ok && !omitField(fv, &fields[i]) {
+			length++
 		}
+	}
 
-		// Marshal the field name as the key
-		if err := marshalString(reflect.ValueOf(fieldName), buf); err != nil {
+	marshalMapHeader(length, e)
+
+	// Yes, we're iterating twice and looking up each field twice, but we
+	// avoid allocations this way.
+
+	for i := range fields {
+		f := &fields[i]
+
+		fieldValue, ok := fieldByIndex(rv, f.index)
+		if !ok || omitField(fieldValue, f) {
+			continue // Skip fields behind nil embedded pointers or empty ones
+		}
+
+		// Write the precomputed field name as the key
+		if _, err := e.Write(f.key); err != nil {
 			return err
 		}
 
 		// Marshal the field value
-		fieldValue := rv.Field(i)
-		if err := marshalAny(fieldValue, buf); err != nil {
-			return err
+		marshalFn := marshalAny
+		if f.quoted {
+			marshalFn = marshalQuoted
+		}
+		if err := marshalFn(fieldValue, e); err != nil {
+			return withPath(err, pathElem{name: f.name})
+		}
+	}
+
+	return nil
+}
+
+// marshalStructAsArray writes the struct's field values as an array, in the
+// order they are declared. Tag options that omit fields are ignored since
+// every position must be filled.
+func marshalStructAsArray(rv reflect.Value, fields []field, e *encodeState) error {
+	marshalArrayHeader(len(fields), e)
+
+	for i := range fields {
+		f := &fields[i]
+
+		fieldValue, ok := fieldByIndex(rv, f.index)
+		if !ok {
+			if err := marshalNil(fieldValue, e); err != nil {
+				return err
+			}
+			continue
+		}
+
+		marshalFn := marshalAny
+		if f.quoted {
+			marshalFn = marshalQuoted
+		}
+		if err := marshalFn(fieldValue, e); err != nil {
+			return withPath(err, pathElem{name: f.name})
 		}
 	}
 
 	return nil
 }
+
+// omitField reports whether a struct field should be left out of the encoding
+// because of its omitempty or omitzero tag options.
+func omitField(rv reflect.Value, f *field) bool {
+	if f.omitEmpty && isEmptyValue(rv) {
+		return true
+	}
+	if f.omitZero && isZeroValue(rv) {
+		return true
+	}
+	return false
+}
+
+// isEmptyValue follows the encoding/json definition of empty: false, 0, a nil
+// pointer or interface, and any empty array, slice, map or string.
+func isEmptyValue(rv reflect.Value) bool {
+	switch rv.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return rv.Len() == 0
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64,
+		reflect.Interface, reflect.Pointer:
+		return rv.IsZero()
+	}
+	return false
+}
+
+// isZeroValue uses the value's IsZero method if it has one, falling back to
+// the language's definition of zero.
+func isZeroValue(rv reflect.Value) bool {
+	if rv.Kind() == reflect.Pointer && rv.IsNil() {
+		return true
+	}
+	if z, ok := cachedTypeInfo(rv.Type()).isZeroer.value(rv); ok {
+		return z.Interface().(interface{ IsZero() bool }).IsZero()
+	}
+	return rv.IsZero()
+}
+
+// marshalQuoted implements the string tag option, encoding a boolean or
+// numeric value as a msgpack string.
+func marshalQuoted(rv reflect.Value, e *encodeState) error {
+	for rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			return marshalNil(rv, e)
+		}
+		rv = rv.Elem()
+	}
+
+	var s string
+	switch rv.Kind() {
+	case reflect.Bool:
+		s = strconv.FormatBool(rv.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		s = strconv.FormatInt(rv.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		s = strconv.FormatUint(rv.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		s = strconv.FormatFloat(rv.Float(), 'g', -1, rv.Type().Bits())
+	default:
+		return marshalAny(rv, e)
+	}
+
+	marshalStringHeader(len(s), e)
+	_, err := e.WriteString(s)
+	return err
+}
+
+// _typeInfoCache holds the *typeInfo for each type seen so far.
+var _typeInfoCache sync.Map // map[reflect.Type]*typeInfo
+
+// typeInfo records which of the interfaces that change how a type is encoded
+// or decoded it implements, so values don't have to be checked one by one.
+type typeInfo struct {
+	marshaler         implKind
+	textMarshaler     implKind
+	binaryMarshaler   implKind
+	isZeroer          implKind
+	textUnmarshaler   implKind
+	binaryUnmarshaler implKind
+	rawExt            bool
+	time              bool
+
+	// ext is set once the type is registered as an ext in any registry, so
+	// that other types can skip the registry lookup.
+	ext atomic.Bool
+}
+
+// implKind says whether a type implements an interface itself, through a
+// pointer to it, or not at all.
+type implKind uint8
+
+const (
+	implNone implKind = iota
+	implValue
+	implPointer
+)
+
+// cachedTypeInfo returns the typeInfo for t, working it out the first time.
+func cachedTypeInfo(t reflect.Type) *typeInfo {
+	if ti, ok := _typeInfoCache.Load(t); ok {
+		return ti.(*typeInfo)
+	}
+
+	ti := &typeInfo{
+		marshaler:         implements(t, _marshalerType),
+		textMarshaler:     implements(t, _textMarshalerType),
+		binaryMarshaler:   implements(t, _binaryMarshalerType),
+		isZeroer:          implements(t, _isZeroerType),
+		textUnmarshaler:   implements(t, _textUnmarshalerType),
+		binaryUnmarshaler: implements(t, _binaryUnmarshalerType),
+		rawExt:            t == _rawExtType,
+		time:              t == _timeType,
+	}
+
+	actual, _ := _typeInfoCache.LoadOrStore(t, ti)
+	return actual.(*typeInfo)
+}
+
+func implements(t, iface reflect.Type) implKind {
+	if t.Implements(iface) {
+		return implValue
+	}
+	if reflect.PointerTo(t).Implements(iface) {
+		return implPointer
+	}
+	return implNone
+}
+
+// value returns rv, or a pointer to it if rv is addressable, if either
+// implements the interface k was worked out for.
+func (k implKind) value(rv reflect.Value) (reflect.Value, bool) {
+	switch {
+	case k == implValue:
+		return rv, true
+	case k == implPointer && rv.CanAddr():
+		return rv.Addr(), true
+	}
+	return rv, false
+}
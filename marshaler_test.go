@@ -0,0 +1,185 @@
+package msgpack_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	msgpack "github.com/cjbottaro/msgpack_go"
+	"github.com/stretchr/testify/require"
+)
+
+// Point encodes itself as a plain "x,y" string.
+type Point struct {
+	X, Y int
+}
+
+func (p Point) MarshalMsgpack() ([]byte, error) {
+	return msgpack.Marshal(fmt.Sprintf("%d,%d", p.X, p.Y))
+}
+
+func (p *Point) UnmarshalMsgpack(data []byte) error {
+	var s string
+	if err := msgpack.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	_, err := fmt.Sscanf(s, "%d,%d", &p.X, &p.Y)
+	return err
+}
+
+// Counter only implements Marshaler on its pointer receiver.
+type Counter struct {
+	n int
+}
+
+func (c *Counter) MarshalMsgpack() ([]byte, error) {
+	return msgpack.Marshal(c.n)
+}
+
+type badMarshaler struct{}
+
+func (badMarshaler) MarshalMsgpack() ([]byte, error) {
+	return []byte{0x92, 0x01}, nil // array missing an element
+}
+
+type failingMarshaler struct{}
+
+func (failingMarshaler) MarshalMsgpack() ([]byte, error) {
+	return nil, errors.New("boom")
+}
+
+func TestMarshaler(t *testing.T) {
+	data, err := msgpack.Marshal(Point{1, 2})
+	require.NoError(t, err)
+	require.Equal(t, msgpack.MustMarshal("1,2"), data)
+
+	data, err = msgpack.Marshal(&Point{3, 4})
+	require.NoError(t, err)
+	require.Equal(t, msgpack.MustMarshal("3,4"), data)
+
+	data, err = msgpack.Marshal(map[string]any{"p": Point{5, 6}})
+	require.NoError(t, err)
+	require.Equal(t, msgpack.MustMarshal(map[string]any{"p": "5,6"}), data)
+
+	var p *Point
+	data, err = msgpack.Marshal(p)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0xc0}, data)
+}
+
+func TestMarshalerPointerReceiver(t *testing.T) {
+	type wrapper struct {
+		C Counter
+	}
+
+	// Addressable, so the pointer method is used.
+	w := &wrapper{C: Counter{n: 7}}
+	data, err := msgpack.Marshal(w)
+	require.NoError(t, err)
+	require.Equal(t, msgpack.MustMarshal(map[string]any{"C": 7}), data)
+
+	data, err = msgpack.Marshal(&Counter{n: 8})
+	require.NoError(t, err)
+	require.Equal(t, msgpack.MustMarshal(8), data)
+}
+
+func TestMarshalerErrors(t *testing.T) {
+	_, err := msgpack.Marshal(badMarshaler{})
+	require.Error(t, err)
+
+	_, err = msgpack.Marshal(failingMarshaler{})
+	require.ErrorContains(t, err, "boom")
+}
+
+func TestUnmarshaler(t *testing.T) {
+	data := msgpack.MustMarshal("1,2")
+
+	var p Point
+	require.NoError(t, msgpack.Unmarshal(data, &p))
+	require.Equal(t, Point{1, 2}, p)
+
+	var pp *Point
+	require.NoError(t, msgpack.Unmarshal(data, &pp))
+	require.Equal(t, &Point{1, 2}, pp)
+
+	data = msgpack.MustMarshal(map[string]any{
+		"points": []any{"1,2", "3,4"},
+		"after":  true,
+	})
+
+	var s struct {
+		Points []Point `msgpack:"points"`
+		After  bool    `msgpack:"after"`
+	}
+	require.NoError(t, msgpack.Unmarshal(data, &s))
+	require.Equal(t, []Point{{1, 2}, {3, 4}}, s.Points)
+	require.True(t, s.After)
+}
+
+// Blob only implements the binary marshaling interfaces.
+type Blob struct {
+	data []byte
+}
+
+func (b Blob) MarshalBinary() ([]byte, error) {
+	return b.data, nil
+}
+
+func (b *Blob) UnmarshalBinary(data []byte) error {
+	b.data = append([]byte(nil), data...)
+	return nil
+}
+
+func TestTextMarshaler(t *testing.T) {
+	addr := netip.MustParseAddr("10.0.0.1")
+
+	data, err := msgpack.Marshal(addr)
+	require.NoError(t, err)
+	require.Equal(t, msgpack.MustMarshal("10.0.0.1"), data)
+
+	var out netip.Addr
+	require.NoError(t, msgpack.Unmarshal(data, &out))
+	require.Equal(t, addr, out)
+
+	var s struct {
+		Addrs []netip.Addr
+	}
+	data = msgpack.MustMarshal(map[string]any{"Addrs": []string{"::1", "127.0.0.1"}})
+	require.NoError(t, msgpack.Unmarshal(data, &s))
+	require.Equal(t, []netip.Addr{netip.IPv6Loopback(), netip.MustParseAddr("127.0.0.1")}, s.Addrs)
+}
+
+func TestBinaryMarshaler(t *testing.T) {
+	data, err := msgpack.Marshal(Blob{data: []byte{1, 2, 3}})
+	require.NoError(t, err)
+	require.Equal(t, []byte{0xc4, 0x03, 1, 2, 3}, data)
+
+	var out Blob
+	require.NoError(t, msgpack.Unmarshal(data, &out))
+	require.Equal(t, []byte{1, 2, 3}, out.data)
+}
+
+func TestPreferStdMarshalers(t *testing.T) {
+	// time.Time is encoded as a timestamp ext, but also implements
+	// encoding.TextMarshaler.
+	tm := time.Date(2024, 11, 25, 2, 19, 12, 0, time.UTC)
+
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	require.NoError(t, enc.Encode(tm))
+	require.NoError(t, enc.Flush())
+	require.Equal(t, byte(0xd6), buf.Bytes()[0]) // fixext4
+
+	buf.Reset()
+	enc.SetPreferStdMarshalers(true)
+	require.NoError(t, enc.Encode(tm))
+	require.NoError(t, enc.Flush())
+	require.Equal(t, msgpack.MustMarshal("2024-11-25T02:19:12Z"), buf.Bytes())
+
+	var out time.Time
+	require.NoError(t, msgpack.Unmarshal(buf.Bytes(), &out))
+	require.True(t, tm.Equal(out))
+}
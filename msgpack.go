@@ -2,158 +2,175 @@ package msgpack
 
 import (
 	"bytes"
-	"encoding/binary"
+	"encoding"
 	"errors"
 	"fmt"
 	"reflect"
-	"time"
+	"strconv"
 )
 
 var (
-	_extRegistryByType = make(map[reflect.Type]extHandler)
-	_extRegistryById   = make(map[int8]extHandler)
-	_anyType           = reflect.TypeOf((*any)(nil)).Elem()
+	_anyType       = reflect.TypeOf((*any)(nil)).Elem()
+	_marshalerType = reflect.TypeOf((*Marshaler)(nil)).Elem()
+
+	_textMarshalerType     = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	_textUnmarshalerType   = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	_binaryMarshalerType   = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	_binaryUnmarshalerType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+	_isZeroerType          = reflect.TypeOf((*interface{ IsZero() bool })(nil)).Elem()
+	_numberType            = reflect.TypeOf(Number(""))
+	_rawExtType            = reflect.TypeOf(RawExt{})
 )
 
-type ExtMarshalFn func(any) ([]byte, error)
-type ExtUnmarshalFn func([]byte) (any, error)
+// Marshaler is the interface implemented by types that can marshal themselves
+// into valid msgpack.
+type Marshaler interface {
+	MarshalMsgpack() ([]byte, error)
+}
 
-type extHandler struct {
-	typeId      int8
-	marshalFn   ExtMarshalFn
-	unmarshalFn ExtUnmarshalFn
+// Unmarshaler is the interface implemented by types that can unmarshal a
+// msgpack encoding of themselves. The input is the complete encoding of a
+// single value and must be copied if it is to be retained.
+type Unmarshaler interface {
+	UnmarshalMsgpack([]byte) error
 }
 
-func Marshal(v any) ([]byte, error) {
-	rv := reflect.ValueOf(v)
-	buf := new(bytes.Buffer)
+// RawMessage is a raw encoded msgpack value. It implements Marshaler and
+// Unmarshaler, and can be used to delay decoding part of a message or to pass
+// it through untouched.
+type RawMessage []byte
 
-	if err := marshalAny(rv, buf); err != nil {
-		return []byte{}, err
+// MarshalMsgpack returns m as the msgpack encoding of m, or nil if m is nil.
+func (m RawMessage) MarshalMsgpack() ([]byte, error) {
+	if m == nil {
+		return []byte{0xc0}, nil
 	}
-
-	return buf.Bytes(), nil
+	return m, nil
 }
 
-func Unmarshal(data []byte, v any) error {
-	rv := reflect.ValueOf(v)
-
-	if rv.Kind() != reflect.Pointer {
-		return fmt.Errorf("msgpack: Unmarshal(non-pointer %s)", rv.Type().String())
+// UnmarshalMsgpack sets *m to a copy of data.
+func (m *RawMessage) UnmarshalMsgpack(data []byte) error {
+	if m == nil {
+		return errors.New("msgpack: RawMessage: UnmarshalMsgpack on nil pointer")
 	}
+	*m = append((*m)[0:0], data...)
+	return nil
+}
 
-	if rv.IsNil() {
-		return fmt.Errorf("msgpack: Unmarshal(nil %s)", rv.Type().String())
-	}
+// A Number is an integer decoded into an interface value by a Decoder set to
+// IntAsNumber, kept in its decimal form. Integers can also be decoded into
+// Number fields and values, and Numbers encode back into integers.
+type Number string
 
-	rv = rv.Elem() // value that we will fill
-	reader := bytes.NewReader(data)
-	return unmarshalAny(rv, reader)
+// String returns the literal text of the number.
+func (n Number) String() string {
+	return string(n)
 }
 
-func MustMarshal(v any) []byte {
-	data, err := Marshal(v)
-	if err != nil {
-		panic(err)
-	}
-	return data
+// Int64 returns the number as an int64.
+func (n Number) Int64() (int64, error) {
+	return strconv.ParseInt(string(n), 10, 64)
 }
 
-func MustUnmarshal(data []byte, v any) {
-	if err := Unmarshal(data, v); err != nil {
-		panic(err)
-	}
+// Uint64 returns the number as a uint64.
+func (n Number) Uint64() (uint64, error) {
+	return strconv.ParseUint(string(n), 10, 64)
 }
 
-func RegisterExt(v any, typeId int8, marshalFn ExtMarshalFn, unmarshalFn ExtUnmarshalFn) {
-	t := reflect.TypeOf(v)
-	if t.Kind() == reflect.Ptr {
-		t = t.Elem()
-	}
+// Float64 returns the number as a float64.
+func (n Number) Float64() (float64, error) {
+	return strconv.ParseFloat(string(n), 64)
+}
 
-	_extRegistryByType[t] = extHandler{
-		typeId:      typeId,
-		marshalFn:   marshalFn,
-		unmarshalFn: unmarshalFn,
+// MarshalMsgpack encodes the number as an integer, or as a float64 if it
+// isn't one.
+func (n Number) MarshalMsgpack() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	e := &encodeState{writer: buf}
+
+	if u, err := n.Uint64(); err == nil {
+		marshalUint64(u, e)
+	} else if i, err := n.Int64(); err == nil {
+		marshalInt64(i, e)
+	} else if f, err := n.Float64(); err == nil {
+		marshalFloat(reflect.ValueOf(f), e)
+	} else {
+		return nil, fmt.Errorf("msgpack: invalid number literal %q", n)
 	}
 
-	_extRegistryById[typeId] = extHandler{
-		typeId:      typeId,
-		marshalFn:   marshalFn,
-		unmarshalFn: unmarshalFn,
-	}
+	return buf.Bytes(), nil
 }
 
-func MarshalTimeExt(v any) ([]byte, error) {
-	t := v.(time.Time)
-	seconds := uint64(t.Unix())
-	nanoseconds := uint64(t.Nanosecond())
+func Marshal(v any) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	buf := new(bytes.Buffer)
+	e := &encodeState{writer: buf, encodeOptions: encodeOptions{exts: DefaultExtRegistry}}
+
+	if err := marshalAny(rv, e); err != nil {
+		return []byte{}, finishPath(err)
+	}
 
-	if (seconds >> 34) == 0 {
-		content := (nanoseconds << 34) | seconds
+	return buf.Bytes(), nil
+}
 
-		if (content & 0xFFFFFFFF00000000) == 0 {
-			var buf [4]byte
-			binary.BigEndian.PutUint32(buf[:], uint32(content))
-			return buf[:], nil
-		}
+// MarshalCanonical is like Marshal but produces canonical output: map keys,
+// and the keys of structs encoded as maps, are sorted by their encoded bytes
+// and integers always use the smallest format that holds them, regardless of
+// their Go type. Equal values therefore always encode to identical bytes,
+// which makes the output suitable for hashing and comparison. Output from
+// Marshaler implementations and ext marshal functions is written as is.
+func MarshalCanonical(v any) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	buf := new(bytes.Buffer)
+	e := &encodeState{writer: buf, encodeOptions: encodeOptions{canonical: true, exts: DefaultExtRegistry}}
 
-		var buf [8]byte
-		binary.BigEndian.PutUint64(buf[:], content)
-		return buf[:], nil
+	if err := marshalAny(rv, e); err != nil {
+		return []byte{}, finishPath(err)
 	}
 
-	var buf [12]byte
-	binary.BigEndian.PutUint32(buf[0:4], uint32(nanoseconds))
-	binary.BigEndian.PutUint64(buf[4:], seconds)
-	return buf[:], nil
+	return buf.Bytes(), nil
 }
 
-func UnmarshalTimeExt(buf []byte) (any, error) {
-	switch len(buf) {
-	case 4:
-		// Decode a 4-byte buffer
-		content := uint64(binary.BigEndian.Uint32(buf))
-		nanoseconds := content >> 34
-		seconds := content & 0x3FFFFFFFF // Mask the lower 34 bits
-		return time.Unix(int64(seconds), int64(nanoseconds)).UTC(), nil
-
-	case 8:
-		// Decode an 8-byte buffer
-		content := binary.BigEndian.Uint64(buf)
-		nanoseconds := content >> 34
-		seconds := content & 0x3FFFFFFFF // Mask the lower 34 bits
-		return time.Unix(int64(seconds), int64(nanoseconds)).UTC(), nil
-
-	case 12:
-		// Decode a 12-byte buffer
-		nanoseconds := binary.BigEndian.Uint32(buf[0:4])
-		seconds := binary.BigEndian.Uint64(buf[4:])
-		return time.Unix(int64(seconds), int64(nanoseconds)).UTC(), nil
-
-	default:
-		return nil, errors.New("msgpack: time ext: invalid size")
+func Unmarshal(data []byte, v any) error {
+	rv, err := unmarshalTarget("Unmarshal", v)
+	if err != nil {
+		return err
 	}
+
+	d := newDecodeState(bytes.NewReader(data), decodeOptions{limits: DefaultLimits, exts: DefaultExtRegistry})
+	return finishPath(unmarshalAny(rv, d))
 }
 
-func structFieldName(f reflect.StructField) (name string) {
-	if f.PkgPath != "" {
-		return ""
-	}
+// unmarshalTarget checks that v is a non-nil pointer and returns the value
+// that it points to, which is what will be filled in.
+func unmarshalTarget(fn string, v any) (reflect.Value, error) {
+	rv := reflect.ValueOf(v)
 
-	name = f.Tag.Get("msgpack")
+	if !rv.IsValid() {
+		return rv, fmt.Errorf("msgpack: %s(nil)", fn)
+	}
 
-	if name == "" {
-		f.Tag.Get("json")
+	if rv.Kind() != reflect.Pointer {
+		return rv, fmt.Errorf("msgpack: %s(non-pointer %s)", fn, rv.Type().String())
 	}
 
-	if name == "" {
-		name = f.Name
+	if rv.IsNil() {
+		return rv, fmt.Errorf("msgpack: %s(nil %s)", fn, rv.Type().String())
 	}
 
-	if name == "-" {
-		return ""
+	return rv.Elem(), nil
+}
+
+func MustMarshal(v any) []byte {
+	data, err := Marshal(v)
+	if err != nil {
+		panic(err)
 	}
+	return data
+}
 
-	return name
+func MustUnmarshal(data []byte, v any) {
+	if err := Unmarshal(data, v); err != nil {
+		panic(err)
+	}
 }
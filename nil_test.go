@@ -0,0 +1,111 @@
+package msgpack_test
+
+import (
+	"bytes"
+	"testing"
+
+	msgpack "github.com/cjbottaro/msgpack_go"
+	"github.com/stretchr/testify/require"
+)
+
+type Nullable struct {
+	Map    map[string]int `msgpack:"map"`
+	Slice  []int          `msgpack:"slice"`
+	Bytes  []byte         `msgpack:"bytes"`
+	Str    string         `msgpack:"str"`
+	Int    int            `msgpack:"int"`
+	Float  float64        `msgpack:"float"`
+	Bool   bool           `msgpack:"bool"`
+	Array  [2]int         `msgpack:"array"`
+	Struct Version        `msgpack:"struct"`
+	Ptr    *int           `msgpack:"ptr"`
+}
+
+func allNil() []byte {
+	m := map[string]any{}
+	for _, k := range []string{"map", "slice", "bytes", "str", "int", "float", "bool", "array", "struct", "ptr"} {
+		m[k] = nil
+	}
+	return msgpack.MustMarshal(m)
+}
+
+func filledNullable() Nullable {
+	one := 1
+	return Nullable{
+		Map:    map[string]int{"a": 1},
+		Slice:  []int{1},
+		Bytes:  []byte{1},
+		Str:    "foo",
+		Int:    1,
+		Float:  1.5,
+		Bool:   true,
+		Array:  [2]int{1, 2},
+		Struct: Version{Major: 1},
+		Ptr:    &one,
+	}
+}
+
+func TestUnmarshalNil(t *testing.T) {
+	out := filledNullable()
+	msgpack.MustUnmarshal(allNil(), &out)
+
+	expected := filledNullable()
+	expected.Map = nil
+	expected.Slice = nil
+	expected.Bytes = nil
+	expected.Ptr = nil
+	require.Equal(t, expected, out)
+
+	// Top level values behave the same way.
+	m := map[string]int{"a": 1}
+	msgpack.MustUnmarshal([]byte{0xc0}, &m)
+	require.Nil(t, m)
+
+	s := "foo"
+	msgpack.MustUnmarshal([]byte{0xc0}, &s)
+	require.Equal(t, "foo", s)
+
+	a := []int{1, 2}
+	msgpack.MustUnmarshal(msgpack.MustMarshal([]any{nil, 3}), &a)
+	require.Equal(t, []int{1, 3}, a)
+}
+
+func TestDecoderSetZeroNil(t *testing.T) {
+	dec := msgpack.NewDecoder(bytes.NewReader(allNil()))
+	dec.SetZeroNil(true)
+
+	out := filledNullable()
+	require.NoError(t, dec.Decode(&out))
+	require.Equal(t, Nullable{}, out)
+}
+
+func TestMarshalNilContainers(t *testing.T) {
+	type S struct {
+		Slice []int          `msgpack:"slice"`
+		Bytes []byte         `msgpack:"bytes"`
+		Map   map[string]int `msgpack:"map"`
+	}
+
+	require.Equal(t, []byte{0xc0}, msgpack.MustMarshal([]int(nil)))
+	require.Equal(t, []byte{0xc0}, msgpack.MustMarshal([]byte(nil)))
+	require.Equal(t, []byte{0xc0}, msgpack.MustMarshal(map[string]int(nil)))
+	require.Equal(t, []byte{0x90}, msgpack.MustMarshal([]int{}))
+	require.Equal(t, []byte{0xc4, 0x00}, msgpack.MustMarshal([]byte{}))
+	require.Equal(t, []byte{0x80}, msgpack.MustMarshal(map[string]int{}))
+
+	// Nil and empty both survive a round trip.
+	for _, in := range []S{{}, {Slice: []int{}, Bytes: []byte{}, Map: map[string]int{}}} {
+		var out S
+		msgpack.MustUnmarshal(msgpack.MustMarshal(in), &out)
+		require.Equal(t, in, out)
+	}
+}
+
+func TestEncoderSetNilAsEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetNilAsEmpty(true)
+	require.NoError(t, enc.Encode([]any{[]int(nil), []byte(nil), map[string]int(nil)}))
+	require.NoError(t, enc.Flush())
+	require.Equal(t, []byte{0x93, 0x90, 0xc4, 0x00, 0x80}, buf.Bytes())
+}
@@ -0,0 +1,49 @@
+package msgpack_test
+
+import (
+	"errors"
+	"testing"
+
+	msgpack "github.com/cjbottaro/msgpack_go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRawExtUnknown(t *testing.T) {
+	data := []byte{
+		0x82,
+		0xa1, 'a', 0xd4, 0x64, 0x2a, // fixext1, type 100
+		0xa1, 'b', 0xc7, 0x03, 0x9c, 0x01, 0x02, 0x03, // ext8, type -100
+	}
+
+	var v any
+	msgpack.MustUnmarshal(data, &v)
+	require.Equal(t, map[string]any{
+		"a": msgpack.RawExt{Type: 100, Data: []byte{0x2a}},
+		"b": msgpack.RawExt{Type: -100, Data: []byte{1, 2, 3}},
+	}, v)
+
+	out, err := msgpack.MarshalCanonical(v)
+	require.NoError(t, err)
+	require.Equal(t, data, out)
+
+	// Unknown exts still can't be decoded into other types.
+	var n int
+	var ee *msgpack.ExtError
+	require.True(t, errors.As(msgpack.Unmarshal([]byte{0xd4, 0x64, 0x2a}, &n), &ee))
+}
+
+func TestRawExtRegistered(t *testing.T) {
+	data := msgpack.MustMarshal(Atom("foo"))
+
+	var raw msgpack.RawExt
+	msgpack.MustUnmarshal(data, &raw)
+	require.Equal(t, msgpack.RawExt{Type: 1, Data: []byte("foo")}, raw)
+	require.Equal(t, data, msgpack.MustMarshal(raw))
+
+	type S struct {
+		Ext *msgpack.RawExt `msgpack:"ext"`
+	}
+	var s S
+	msgpack.MustUnmarshal(msgpack.MustMarshal(map[string]any{"ext": Atom("bar")}), &s)
+	require.Equal(t, &msgpack.RawExt{Type: 1, Data: []byte("bar")}, s.Ext)
+}
@@ -0,0 +1,60 @@
+package msgpack_test
+
+import (
+	"testing"
+
+	msgpack "github.com/cjbottaro/msgpack_go"
+	"github.com/stretchr/testify/require"
+)
+
+type Envelope struct {
+	Type    string             `msgpack:"type"`
+	Payload msgpack.RawMessage `msgpack:"payload"`
+}
+
+func TestRawMessage(t *testing.T) {
+	payload := map[string]any{"id": 1, "tags": []string{"a", "b"}}
+	data, err := msgpack.MarshalCanonical(map[string]any{"type": "created", "payload": payload})
+	require.NoError(t, err)
+	expected, err := msgpack.MarshalCanonical(payload)
+	require.NoError(t, err)
+
+	var env Envelope
+	msgpack.MustUnmarshal(data, &env)
+	require.Equal(t, "created", env.Type)
+	require.Equal(t, msgpack.RawMessage(expected), env.Payload)
+
+	// The payload is written back verbatim.
+	var m map[string]msgpack.RawMessage
+	msgpack.MustUnmarshal(msgpack.MustMarshal(env), &m)
+	require.Equal(t, env.Payload, m["payload"])
+
+	var out struct {
+		ID   int      `msgpack:"id"`
+		Tags []string `msgpack:"tags"`
+	}
+	msgpack.MustUnmarshal(env.Payload, &out)
+	require.Equal(t, 1, out.ID)
+	require.Equal(t, []string{"a", "b"}, out.Tags)
+}
+
+func TestRawMessageNil(t *testing.T) {
+	require.Equal(t, []byte{0x81, 0xa1, 'p', 0xc0}, msgpack.MustMarshal(map[string]msgpack.RawMessage{"p": nil}))
+
+	// A msgpack nil is kept as is, rather than resetting the RawMessage.
+	var raw msgpack.RawMessage
+	msgpack.MustUnmarshal([]byte{0xc0}, &raw)
+	require.Equal(t, msgpack.RawMessage{0xc0}, raw)
+
+	var ptr *msgpack.RawMessage
+	msgpack.MustUnmarshal([]byte{0xc0}, &ptr)
+	require.Nil(t, ptr)
+}
+
+func TestRawMessageInvalid(t *testing.T) {
+	_, err := msgpack.Marshal(msgpack.RawMessage{0x92, 0x01})
+	require.Error(t, err)
+
+	_, err = msgpack.Marshal(msgpack.RawMessage{0x01, 0x02})
+	require.Error(t, err)
+}
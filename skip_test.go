@@ -0,0 +1,94 @@
+package msgpack_test
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	msgpack "github.com/cjbottaro/msgpack_go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecoderSkip(t *testing.T) {
+	values := []any{
+		map[string]any{"a": []any{1, "two", 3.0, []byte("four")}, "b": nil},
+		strings.Repeat("x", 1000),
+		[]byte{0xd4, 0x64, 0x00}, // bin, not an ext
+		true,
+	}
+
+	var buf bytes.Buffer
+	for _, v := range values {
+		buf.Write(msgpack.MustMarshal(v))
+	}
+	buf.Write([]byte{0xd4, 0x64, 0x00}) // ext with an unregistered id
+	buf.Write(msgpack.MustMarshal("last"))
+
+	// bytes.Reader, bufio.Reader and anything else are skipped differently.
+	readers := map[string]func() io.Reader{
+		"bytes":  func() io.Reader { return bytes.NewReader(buf.Bytes()) },
+		"bufio":  func() io.Reader { return bufio.NewReader(bytes.NewReader(buf.Bytes())) },
+		"reader": func() io.Reader { return io.MultiReader(bytes.NewReader(buf.Bytes())) },
+	}
+
+	for name, reader := range readers {
+		t.Run(name, func(t *testing.T) {
+			dec := msgpack.NewDecoder(reader())
+			for range values {
+				require.NoError(t, dec.Skip())
+			}
+			require.NoError(t, dec.Skip())
+
+			var s string
+			require.NoError(t, dec.Decode(&s))
+			require.Equal(t, "last", s)
+
+			require.Equal(t, io.EOF, dec.Skip())
+		})
+	}
+}
+
+func TestDecoderSkipTruncated(t *testing.T) {
+	data := msgpack.MustMarshal([]string{"foo", strings.Repeat("x", 100)})
+
+	dec := msgpack.NewDecoder(bytes.NewReader(data[:len(data)-1]))
+	require.ErrorIs(t, dec.Skip(), io.ErrUnexpectedEOF)
+
+	dec = msgpack.NewDecoder(bufio.NewReader(bytes.NewReader(data[:len(data)-1])))
+	require.ErrorIs(t, dec.Skip(), io.ErrUnexpectedEOF)
+}
+
+func TestUnmarshalSkipsUnknownFields(t *testing.T) {
+	type S struct {
+		Name string `msgpack:"name"`
+	}
+
+	// Unknown fields may hold anything, including exts nobody registered.
+	unknown := []byte{0x92, 0xd4, 0x64, 0x00, 0xc7, 0x03, 0x65, 0x01, 0x02, 0x03}
+
+	var buf bytes.Buffer
+	buf.WriteByte(0x83)
+	buf.Write(msgpack.MustMarshal("unknown"))
+	buf.Write(unknown)
+	buf.Write(msgpack.MustMarshal("name"))
+	buf.Write(msgpack.MustMarshal("foo"))
+	buf.Write(msgpack.MustMarshal(map[string]any{"big": strings.Repeat("x", 10000)}))
+	buf.Write(msgpack.MustMarshal([]int{1, 2, 3}))
+
+	var s S
+	msgpack.MustUnmarshal(buf.Bytes(), &s)
+	require.Equal(t, S{Name: "foo"}, s)
+
+	// Skipping costs no more allocations than there not being anything to
+	// skip.
+	small := msgpack.MustMarshal(map[string]any{"name": "foo"})
+	expected := testing.AllocsPerRun(10, func() {
+		msgpack.MustUnmarshal(small, &s)
+	})
+	allocs := testing.AllocsPerRun(10, func() {
+		msgpack.MustUnmarshal(buf.Bytes(), &s)
+	})
+	require.Equal(t, expected, allocs)
+}
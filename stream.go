@@ -0,0 +1,258 @@
+package msgpack
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+)
+
+// An Encoder writes msgpack values to an output stream.
+type Encoder struct {
+	w      writer // a *bufio.Writer, or a *bytes.Buffer for nested exts
+	opts   encodeOptions
+	nested bool // encoding the data of a nested ext
+}
+
+// NewEncoder returns a new encoder that writes to w.
+//
+// Output is buffered internally; call Flush once done writing values to make
+// sure everything reaches w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: bufio.NewWriter(w), opts: encodeOptions{exts: DefaultExtRegistry}}
+}
+
+// Encode writes the msgpack encoding of v to the stream.
+//
+// Values are written straight into the stream as they are encoded, so if an
+// error is returned the stream may contain a partially encoded value.
+func (enc *Encoder) Encode(v any) error {
+	e := &encodeState{writer: enc.w, encodeOptions: enc.opts}
+	err := marshalAny(reflect.ValueOf(v), e)
+	if !enc.nested {
+		// Errors from nested exts carry on collecting their path on the
+		// way out of the enclosing encoder.
+		err = finishPath(err)
+	}
+	return err
+}
+
+// SetPreferStdMarshalers controls whether encoding.TextMarshaler and
+// encoding.BinaryMarshaler take precedence over registered exts for types that
+// have both. By default the registered ext wins. This includes time.Time,
+// which is otherwise encoded as a timestamp ext.
+func (enc *Encoder) SetPreferStdMarshalers(on bool) {
+	enc.opts.preferStdMarshalers = on
+}
+
+// Flush writes any buffered data to the underlying io.Writer.
+func (enc *Encoder) Flush() error {
+	if w, ok := enc.w.(*bufio.Writer); ok {
+		return w.Flush()
+	}
+	return nil
+}
+
+// SetStructAsArray makes the encoder write every struct as an array of its
+// field values in declaration order, instead of a map keyed by field name.
+// Individual struct types can opt in with a blank field tagged asarray:
+//
+//	_ struct{} `msgpack:",asarray"`
+//
+// Decoding accepts either form regardless.
+func (enc *Encoder) SetStructAsArray(on bool) {
+	enc.opts.structAsArray = on
+}
+
+// SetCanonical makes the encoder produce canonical output; see
+// MarshalCanonical.
+func (enc *Encoder) SetCanonical(on bool) {
+	enc.opts.canonical = on
+}
+
+// SetNilAsEmpty makes the encoder write nil slices and maps as empty arrays,
+// bins and maps. By default they are written as nil, which decodes back into
+// a nil slice or map, while empty ones decode back as empty.
+func (enc *Encoder) SetNilAsEmpty(on bool) {
+	enc.opts.nilAsEmpty = on
+}
+
+// SetExtRegistry makes the encoder use the exts registered with r instead of
+// those registered with DefaultExtRegistry. A nil r restores
+// DefaultExtRegistry.
+func (enc *Encoder) SetExtRegistry(r *ExtRegistry) {
+	if r == nil {
+		r = DefaultExtRegistry
+	}
+	enc.opts.exts = r
+}
+
+// A Decoder reads successive msgpack values from an input stream.
+type Decoder struct {
+	r    byteReader
+	buf  *bufio.Reader // set if r had to be wrapped
+	opts decodeOptions
+
+	offset int64 // bytes decoded so far, so error offsets are relative to the stream
+
+	// The decoder that came across the ext whose data this decoder reads,
+	// for exts registered with RegisterNestedExtIn.
+	parent *decodeState
+}
+
+// NewDecoder returns a new decoder that reads from r.
+//
+// If r implements io.ByteReader it is read from directly and the decoder never
+// consumes more bytes than the values it decodes. Otherwise r is wrapped in a
+// bufio.Reader, which may read ahead; see Buffered.
+func NewDecoder(r io.Reader) *Decoder {
+	opts := decodeOptions{limits: DefaultLimits, exts: DefaultExtRegistry}
+	if br, ok := r.(byteReader); ok {
+		return &Decoder{r: br, opts: opts}
+	}
+	buf := bufio.NewReader(r)
+	return &Decoder{r: buf, buf: buf, opts: opts}
+}
+
+// Decode reads the next msgpack value from the stream and stores it in the
+// value pointed to by v.
+//
+// At the end of the stream Decode returns io.EOF. If the stream ends in the
+// middle of a value, io.ErrUnexpectedEOF is returned instead.
+func (dec *Decoder) Decode(v any) error {
+	rv, err := unmarshalTarget("Decode", v)
+	if err != nil {
+		return err
+	}
+
+	d := dec.newState()
+	defer dec.done(d)
+
+	b, err := d.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	err = unmarshalValue(b, rv, d)
+	if dec.parent == nil {
+		err = finishPath(err)
+	}
+	return unexpectedEOF(err)
+}
+
+// Skip reads past the next msgpack value in the stream without decoding it.
+// Like Decode, it returns io.EOF at the end of the stream.
+func (dec *Decoder) Skip() error {
+	d := dec.newState()
+	defer dec.done(d)
+
+	b, err := d.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	err = skipValue(b, d)
+	return unexpectedEOF(err)
+}
+
+// unexpectedEOF reports the input ending in the middle of a value as
+// io.ErrUnexpectedEOF, keeping any error that wraps io.EOF intact.
+func unexpectedEOF(err error) error {
+	switch {
+	case err == io.EOF:
+		return io.ErrUnexpectedEOF
+	case errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF):
+		return fmt.Errorf("%w (%w)", err, io.ErrUnexpectedEOF)
+	}
+	return err
+}
+
+// newState returns the state for decoding the next value, which continues the
+// depth and allocations of the parent decoder if there is one.
+func (dec *Decoder) newState() *decodeState {
+	d := newDecodeState(dec.r, dec.opts)
+	d.offset = dec.offset
+	if dec.parent != nil {
+		d.depth = dec.parent.depth
+		d.allocated = dec.parent.allocated
+	}
+	return d
+}
+
+// done records what decoding d consumed.
+func (dec *Decoder) done(d *decodeState) {
+	dec.offset = d.offset
+	if dec.parent != nil {
+		dec.parent.allocated = d.allocated
+	}
+}
+
+// SetLimits replaces the limits enforced on each decoded value, which default
+// to DefaultLimits. Set them when decoding input from untrusted sources.
+func (dec *Decoder) SetLimits(limits Limits) {
+	dec.opts.limits = limits
+}
+
+// SetFixedArrayMode controls how a msgpack array or bin whose length differs
+// from that of the Go array it is decoded into is handled. By default it is an
+// error.
+func (dec *Decoder) SetFixedArrayMode(mode FixedArrayMode) {
+	dec.opts.fixedArrayMode = mode
+}
+
+// SetZeroNil makes a msgpack nil set any Go value it is decoded into to its
+// zero value. By default only pointers, interfaces, maps and slices are reset
+// to nil, and other values are left unchanged, like encoding/json does.
+func (dec *Decoder) SetZeroNil(on bool) {
+	dec.opts.zeroNil = on
+}
+
+// SetMapMode selects the Go type that maps are decoded into when the target
+// is an interface value. By default it is map[string]any if every key is a
+// string and map[any]any otherwise.
+func (dec *Decoder) SetMapMode(mode MapMode) {
+	dec.opts.mapMode = mode
+}
+
+// SetIntMode selects the Go type that integers are decoded into when the
+// target is an interface value. By default it is int64, or uint64 for
+// unsigned formats.
+func (dec *Decoder) SetIntMode(mode IntMode) {
+	dec.opts.intMode = mode
+}
+
+// SetKeepFloat32 makes float32 values decode into float32 rather than
+// float64 when the target is an interface value.
+func (dec *Decoder) SetKeepFloat32(on bool) {
+	dec.opts.keepFloat32 = on
+}
+
+// SetExtRegistry makes the decoder use the exts registered with r instead of
+// those registered with DefaultExtRegistry. A nil r restores
+// DefaultExtRegistry.
+func (dec *Decoder) SetExtRegistry(r *ExtRegistry) {
+	if r == nil {
+		r = DefaultExtRegistry
+	}
+	dec.opts.exts = r
+}
+
+// SetTimeLocation sets the location of time.Time values decoded from
+// timestamps, which carry no location of their own. The default is UTC.
+func (dec *Decoder) SetTimeLocation(loc *time.Location) {
+	dec.opts.timeLocation = loc
+}
+
+// Buffered returns a reader of the data remaining in the decoder's buffer.
+// It is only non-empty if the decoder had to wrap its reader in a
+// bufio.Reader.
+func (dec *Decoder) Buffered() io.Reader {
+	if dec.buf == nil {
+		return bytes.NewReader(nil)
+	}
+	data, _ := dec.buf.Peek(dec.buf.Buffered())
+	return bytes.NewReader(data)
+}
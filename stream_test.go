@@ -0,0 +1,95 @@
+package msgpack_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	msgpack "github.com/cjbottaro/msgpack_go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+
+	require.NoError(t, enc.Encode(1))
+	require.NoError(t, enc.Encode("foo"))
+	require.NoError(t, enc.Encode(map[string]any{"bar": true}))
+
+	// Nothing is written until the encoder is flushed.
+	require.Equal(t, 0, buf.Len())
+	require.NoError(t, enc.Flush())
+
+	var expected []byte
+	expected = append(expected, msgpack.MustMarshal(1)...)
+	expected = append(expected, msgpack.MustMarshal("foo")...)
+	expected = append(expected, msgpack.MustMarshal(map[string]any{"bar": true})...)
+	require.Equal(t, expected, buf.Bytes())
+}
+
+func TestEncoderLargeValue(t *testing.T) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+
+	v := make([]string, 1000)
+	for i := range v {
+		v[i] = "some longer string value to overflow the internal buffer"
+	}
+
+	require.NoError(t, enc.Encode(v))
+	require.NoError(t, enc.Flush())
+	require.Equal(t, msgpack.MustMarshal(v), buf.Bytes())
+}
+
+func TestDecoder(t *testing.T) {
+	var data []byte
+	data = append(data, msgpack.MustMarshal(1)...)
+	data = append(data, msgpack.MustMarshal("foo")...)
+	data = append(data, msgpack.MustMarshal([]int{1, 2, 3})...)
+
+	// Hide the io.ByteReader implementation so the decoder has to buffer.
+	dec := msgpack.NewDecoder(struct{ io.Reader }{bytes.NewReader(data)})
+
+	var i int
+	require.NoError(t, dec.Decode(&i))
+	require.Equal(t, 1, i)
+
+	var s string
+	require.NoError(t, dec.Decode(&s))
+	require.Equal(t, "foo", s)
+
+	var a []int
+	require.NoError(t, dec.Decode(&a))
+	require.Equal(t, []int{1, 2, 3}, a)
+
+	var v any
+	require.Equal(t, io.EOF, dec.Decode(&v))
+}
+
+func TestDecoderExactReads(t *testing.T) {
+	data := msgpack.MustMarshal("foo")
+	data = append(data, 0xff, 0xff)
+
+	r := bytes.NewReader(data)
+	dec := msgpack.NewDecoder(r)
+
+	var s string
+	require.NoError(t, dec.Decode(&s))
+	require.Equal(t, "foo", s)
+	require.Equal(t, 2, r.Len())
+}
+
+func TestDecoderUnexpectedEOF(t *testing.T) {
+	data := msgpack.MustMarshal("foobar")
+	dec := msgpack.NewDecoder(bytes.NewReader(data[:3]))
+
+	var s string
+	require.ErrorIs(t, dec.Decode(&s), io.ErrUnexpectedEOF)
+
+	data = msgpack.MustMarshal([]int{1, 2})
+	dec = msgpack.NewDecoder(bytes.NewReader(data[:2]))
+
+	var a []int
+	require.ErrorIs(t, dec.Decode(&a), io.ErrUnexpectedEOF)
+}
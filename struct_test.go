@@ -0,0 +1,415 @@
+package msgpack_test
+
+import (
+	"bytes"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	msgpack "github.com/cjbottaro/msgpack_go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Version has an IsZero method that disagrees with the language's zero.
+type Version struct {
+	Major, Minor int
+}
+
+func (v Version) IsZero() bool {
+	return v.Major == 0
+}
+
+func TestStructTagName(t *testing.T) {
+	type S struct {
+		Foo    int `msgpack:"foo"`
+		Bar    int `msgpack:",omitempty"`
+		Dash   int `msgpack:"-,"`
+		Hidden int `msgpack:"-"`
+	}
+
+	data := msgpack.MustMarshal(S{Foo: 1, Bar: 2, Dash: 3, Hidden: 4})
+
+	var m map[string]int
+	msgpack.MustUnmarshal(data, &m)
+	require.Equal(t, map[string]int{"foo": 1, "Bar": 2, "-": 3}, m)
+
+	var s S
+	msgpack.MustUnmarshal(data, &s)
+	require.Equal(t, S{Foo: 1, Bar: 2, Dash: 3}, s)
+}
+
+func TestStructOmitEmpty(t *testing.T) {
+	type S struct {
+		Int    int            `msgpack:"int,omitempty"`
+		Str    string         `msgpack:"str,omitempty"`
+		Bool   bool           `msgpack:"bool,omitempty"`
+		Ptr    *int           `msgpack:"ptr,omitempty"`
+		Slice  []int          `msgpack:"slice,omitempty"`
+		Map    map[string]int `msgpack:"map,omitempty"`
+		Any    any            `msgpack:"any,omitempty"`
+		Struct Version        `msgpack:"struct,omitempty"` // never empty
+		Always int            `msgpack:"always"`
+	}
+
+	var m map[string]any
+	msgpack.MustUnmarshal(msgpack.MustMarshal(S{Slice: []int{}}), &m)
+	require.ElementsMatch(t, []string{"struct", "always"}, keys(m))
+
+	zero := 0
+	msgpack.MustUnmarshal(msgpack.MustMarshal(S{Int: 1, Ptr: &zero, Slice: []int{1}}), &m)
+	require.ElementsMatch(t, []string{"int", "ptr", "slice", "struct", "always"}, keys(m))
+}
+
+func TestStructOmitZero(t *testing.T) {
+	type S struct {
+		Version Version   `msgpack:"version,omitzero"`
+		Time    time.Time `msgpack:"time,omitzero"`
+		Slice   []int     `msgpack:"slice,omitzero"`
+		Ptr     *int      `msgpack:"ptr,omitzero"`
+	}
+
+	var m map[string]any
+	msgpack.MustUnmarshal(msgpack.MustMarshal(S{Version: Version{Minor: 1}}), &m)
+	require.Empty(t, m)
+
+	zero := 0
+	msgpack.MustUnmarshal(msgpack.MustMarshal(S{Slice: []int{}, Ptr: &zero}), &m)
+	require.ElementsMatch(t, []string{"slice", "ptr"}, keys(m))
+}
+
+func TestStructStringOption(t *testing.T) {
+	type S struct {
+		Int   int     `msgpack:"int,string"`
+		Uint  *uint8  `msgpack:"uint,string"`
+		Float float64 `msgpack:"float,string"`
+		Bool  bool    `msgpack:"bool,string"`
+		Str   string  `msgpack:"str,string"`
+	}
+
+	u := uint8(200)
+	in := S{Int: -42, Uint: &u, Float: 1.5, Bool: true, Str: "foo"}
+	data := msgpack.MustMarshal(in)
+
+	var m map[string]any
+	msgpack.MustUnmarshal(data, &m)
+	require.Equal(t, map[string]any{
+		"int":   "-42",
+		"uint":  "200",
+		"float": "1.5",
+		"bool":  "true",
+		"str":   "foo",
+	}, m)
+
+	var out S
+	msgpack.MustUnmarshal(data, &out)
+	require.Equal(t, in, out)
+
+	// Unquoted values are still accepted.
+	msgpack.MustUnmarshal(msgpack.MustMarshal(map[string]any{"int": 7}), &out)
+	require.Equal(t, 7, out.Int)
+
+	err := msgpack.Unmarshal(msgpack.MustMarshal(map[string]any{"uint": "300"}), &out)
+	require.Error(t, err)
+
+	err = msgpack.Unmarshal(msgpack.MustMarshal(map[string]any{"bool": "yes please"}), &out)
+	require.Error(t, err)
+}
+
+func TestStructStringOptionIgnored(t *testing.T) {
+	// Like encoding/json, the option only applies to booleans, numbers and
+	// strings.
+	type S struct {
+		Any  any        `msgpack:"any,string"`
+		Addr netip.Addr `msgpack:"addr,string"`
+	}
+
+	in := S{Any: int64(7), Addr: netip.MustParseAddr("10.0.0.1")}
+	data := msgpack.MustMarshal(in)
+
+	var m map[string]any
+	msgpack.MustUnmarshal(data, &m)
+	require.Equal(t, map[string]any{"any": int64(7), "addr": "10.0.0.1"}, m)
+
+	var out S
+	require.NoError(t, msgpack.Unmarshal(data, &out))
+	require.Equal(t, in, out)
+}
+
+func keys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func TestStructJSONTagFallback(t *testing.T) {
+	type S struct {
+		Name    string `json:"name"`
+		Empty   string `json:"empty,omitempty"`
+		Count   int    `json:"count,string"`
+		Skipped string `json:"-"`
+		Both    string `json:"json_name" msgpack:"msgpack_name"`
+		NoName  int    `json:",omitempty"`
+		Plain   int
+
+		// The string option is ignored for these, as it is by encoding/json.
+		Any  any        `json:"any,string"`
+		Addr netip.Addr `json:"addr,string"`
+	}
+
+	in := S{Name: "foo", Count: 3, Skipped: "bar", Both: "baz", Any: int64(5), Addr: netip.MustParseAddr("::1")}
+	data := msgpack.MustMarshal(in)
+
+	var m map[string]any
+	msgpack.MustUnmarshal(data, &m)
+	require.Equal(t, map[string]any{
+		"name":         "foo",
+		"count":        "3",
+		"msgpack_name": "baz",
+		"Plain":        int64(0),
+		"any":          int64(5),
+		"addr":         "::1",
+	}, m)
+
+	var out S
+	msgpack.MustUnmarshal(data, &out)
+	in.Skipped = ""
+	require.Equal(t, in, out)
+}
+
+type Base struct {
+	ID      int    `msgpack:"id"`
+	Created string `msgpack:"created"`
+}
+
+type Audit struct {
+	Created string `msgpack:"created"`
+	Updated string `msgpack:"updated"`
+}
+
+type named struct {
+	Name string `msgpack:"name"`
+}
+
+func TestStructEmbedded(t *testing.T) {
+	type Record struct {
+		Base
+		*Audit
+		named
+		Value string `msgpack:"value"`
+	}
+
+	// Base.Created and Audit.Created are at the same depth, so neither is
+	// encoded.
+	in := Record{
+		Base:  Base{ID: 1, Created: "ignored"},
+		Audit: &Audit{Created: "ignored", Updated: "today"},
+		named: named{Name: "foo"},
+		Value: "bar",
+	}
+	data := msgpack.MustMarshal(in)
+
+	var m map[string]any
+	msgpack.MustUnmarshal(data, &m)
+	require.Equal(t, map[string]any{
+		"id":      int64(1),
+		"updated": "today",
+		"name":    "foo",
+		"value":   "bar",
+	}, m)
+
+	var out Record
+	msgpack.MustUnmarshal(data, &out)
+	require.Equal(t, Record{
+		Base:  Base{ID: 1},
+		Audit: &Audit{Updated: "today"},
+		named: named{Name: "foo"},
+		Value: "bar",
+	}, out)
+
+	// Fields behind a nil embedded pointer are left out.
+	m = nil
+	msgpack.MustUnmarshal(msgpack.MustMarshal(Record{Value: "bar"}), &m)
+	require.NotContains(t, m, "updated")
+}
+
+func TestStructEmbeddedShadowing(t *testing.T) {
+	type Inner struct {
+		A string `msgpack:"a"`
+		B string `msgpack:"b"`
+	}
+
+	type Tagged struct {
+		C string `msgpack:"c"`
+	}
+
+	type Untagged struct {
+		C string
+	}
+
+	type Outer struct {
+		Inner
+		Tagged
+		Untagged
+		A      string `msgpack:"a"` // shadows Inner.A
+		Inner2 Inner  // not embedded, so nested
+	}
+
+	in := Outer{
+		Inner:    Inner{A: "inner a", B: "inner b"},
+		Tagged:   Tagged{C: "tagged c"},
+		Untagged: Untagged{C: "untagged c"},
+		A:        "outer a",
+		Inner2:   Inner{A: "a2"},
+	}
+	data := msgpack.MustMarshal(in)
+
+	var m map[string]any
+	msgpack.MustUnmarshal(data, &m)
+	require.Equal(t, map[string]any{
+		"a":      "outer a",
+		"b":      "inner b",
+		"c":      "tagged c",
+		"C":      "untagged c",
+		"Inner2": map[string]any{"a": "a2", "b": ""},
+	}, m)
+
+	var out Outer
+	msgpack.MustUnmarshal(data, &out)
+	in.Inner.A = ""
+	require.Equal(t, in, out)
+}
+
+func TestStructEmbeddedTaggedStruct(t *testing.T) {
+	type Wrapper struct {
+		Base `msgpack:"base"`
+	}
+
+	var m map[string]any
+	msgpack.MustUnmarshal(msgpack.MustMarshal(Wrapper{Base{ID: 1}}), &m)
+	require.Equal(t, map[string]any{
+		"base": map[string]any{"id": int64(1), "created": ""},
+	}, m)
+}
+
+func TestStructConcurrent(t *testing.T) {
+	type S struct {
+		Base
+		Name  string   `msgpack:"name,omitempty"`
+		Tags  []string `msgpack:"tags"`
+		Count int      `msgpack:"count,string"`
+	}
+
+	in := S{Base: Base{ID: 1}, Name: "foo", Tags: []string{"a", "b"}, Count: 3}
+	expected := msgpack.MustMarshal(in)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				data, err := msgpack.Marshal(in)
+				assert.NoError(t, err)
+				assert.Equal(t, expected, data)
+
+				var out S
+				assert.NoError(t, msgpack.Unmarshal(data, &out))
+				assert.Equal(t, in, out)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+type Sample struct {
+	_     struct{} `msgpack:",asarray"`
+	Name  string   `msgpack:"name"`
+	Value float64  `msgpack:"value,omitempty"`
+	Tags  []string `msgpack:"tags"`
+}
+
+func TestStructAsArray(t *testing.T) {
+	in := Sample{Name: "cpu", Tags: []string{"a"}}
+	data := msgpack.MustMarshal(in)
+
+	var a []any
+	msgpack.MustUnmarshal(data, &a)
+	require.Equal(t, []any{"cpu", float64(0), []any{"a"}}, a)
+
+	var out Sample
+	msgpack.MustUnmarshal(data, &out)
+	require.Equal(t, in, out)
+
+	// Extra elements are discarded and missing ones leave fields untouched.
+	out = Sample{Tags: []string{"b"}}
+	msgpack.MustUnmarshal(msgpack.MustMarshal([]any{"mem", 1.5}), &out)
+	require.Equal(t, Sample{Name: "mem", Value: 1.5, Tags: []string{"b"}}, out)
+
+	msgpack.MustUnmarshal(msgpack.MustMarshal([]any{"disk", 2.5, []string{}, "extra", map[string]any{}}), &out)
+	require.Equal(t, Sample{Name: "disk", Value: 2.5, Tags: []string{}}, out)
+}
+
+func TestStructAsArrayEncoderOption(t *testing.T) {
+	type Point3 struct {
+		X, Y, Z int
+	}
+
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetStructAsArray(true)
+	require.NoError(t, enc.Encode(map[string]Point3{"p": {1, 2, 3}}))
+	require.NoError(t, enc.Flush())
+	require.Equal(t, msgpack.MustMarshal(map[string][]int{"p": {1, 2, 3}}), buf.Bytes())
+
+	var out map[string]Point3
+	msgpack.MustUnmarshal(buf.Bytes(), &out)
+	require.Equal(t, map[string]Point3{"p": {1, 2, 3}}, out)
+}
+
+func TestStructIntKeys(t *testing.T) {
+	type Message struct {
+		ID      int    `msgpack:"1,keyasint"`
+		Body    string `msgpack:"2,keyasint,omitempty"`
+		Version int    `msgpack:"-3,keyasint"`
+		Name    string `msgpack:"name"`
+	}
+
+	in := Message{ID: 7, Body: "hello", Version: 2, Name: "foo"}
+	data := msgpack.MustMarshal(in)
+
+	var m map[any]any
+	msgpack.MustUnmarshal(data, &m)
+	require.Equal(t, map[any]any{
+		int64(1):  int64(7),
+		int64(2):  "hello",
+		int64(-3): int64(2),
+		"name":    "foo",
+	}, m)
+
+	var out Message
+	msgpack.MustUnmarshal(data, &out)
+	require.Equal(t, in, out)
+
+	// Unsigned integer keys, string keys and unknown keys of other types.
+	data = msgpack.MustMarshal(map[any]any{
+		uint8(1): 8,
+		"2":      "world",
+		3.5:      "ignored",
+		int64(9): "ignored",
+
+		uint64(1 << 63): "ignored",
+	})
+	out = Message{}
+	msgpack.MustUnmarshal(data, &out)
+	require.Equal(t, Message{ID: 8, Body: "world"}, out)
+
+	// A small key in the uint64 format still matches.
+	data = []byte{0x81, 0xcf, 0, 0, 0, 0, 0, 0, 0, 1, 0x05}
+	out = Message{}
+	msgpack.MustUnmarshal(data, &out)
+	require.Equal(t, Message{ID: 5}, out)
+}
@@ -0,0 +1,128 @@
+package msgpack
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"reflect"
+	"time"
+)
+
+// timestampExt is the ext type the msgpack spec assigns to timestamps.
+// time.Time is encoded as it unless another ext is registered for it, and it
+// decodes into time.Time unless another type is registered for it.
+const timestampExt int8 = -1
+
+var (
+	_timeType = reflect.TypeOf(time.Time{})
+
+	// The range of time.Time.UnixNano.
+	_minUnixNano = time.Unix(0, math.MinInt64)
+	_maxUnixNano = time.Unix(0, math.MaxInt64)
+)
+
+// MarshalTimeExt encodes a time.Time as the data of a timestamp ext.
+//
+// Deprecated: time.Time is encoded as a timestamp without registering
+// anything.
+func MarshalTimeExt(v any) ([]byte, error) {
+	return encodeTimestamp(v.(time.Time)), nil
+}
+
+// UnmarshalTimeExt decodes the data of a timestamp ext into a time.Time in
+// UTC.
+//
+// Deprecated: timestamps decode into time.Time without registering anything.
+func UnmarshalTimeExt(buf []byte) (any, error) {
+	return decodeTimestamp(buf, time.UTC)
+}
+
+// encodeTimestamp returns the data of the smallest of the three timestamp
+// forms that holds t.
+func encodeTimestamp(t time.Time) []byte {
+	sec := t.Unix()
+	nsec := int64(t.Nanosecond())
+
+	if sec>>34 == 0 {
+		content := uint64(nsec)<<34 | uint64(sec)
+
+		if nsec == 0 && sec <= math.MaxUint32 {
+			buf := make([]byte, 4) // timestamp 32
+			binary.BigEndian.PutUint32(buf, uint32(content))
+			return buf
+		}
+
+		buf := make([]byte, 8) // timestamp 64
+		binary.BigEndian.PutUint64(buf, content)
+		return buf
+	}
+
+	// Only timestamp 96 has signed seconds, which is needed before 1970.
+	buf := make([]byte, 12)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(nsec))
+	binary.BigEndian.PutUint64(buf[4:], uint64(sec))
+	return buf
+}
+
+func decodeTimestamp(buf []byte, loc *time.Location) (time.Time, error) {
+	var sec, nsec int64
+
+	switch len(buf) {
+	case 4:
+		sec = int64(binary.BigEndian.Uint32(buf))
+	case 8:
+		content := binary.BigEndian.Uint64(buf)
+		nsec = int64(content >> 34)
+		sec = int64(content & 0x3ffffffff) // lower 34 bits
+	case 12:
+		nsec = int64(binary.BigEndian.Uint32(buf[0:4]))
+		sec = int64(binary.BigEndian.Uint64(buf[4:]))
+	default:
+		return time.Time{}, errors.New("msgpack: time ext: invalid size")
+	}
+
+	if nsec > 999999999 {
+		return time.Time{}, errors.New("msgpack: time ext: nanoseconds out of range")
+	}
+
+	return time.Unix(sec, nsec).In(loc), nil
+}
+
+func marshalTime(rv reflect.Value, e *encodeState) error {
+	data := encodeTimestamp(rv.Interface().(time.Time))
+	marshalExtHeader(len(data), timestampExt, e)
+	_, err := e.Write(data)
+	return err
+}
+
+// unmarshalTime stores a timestamp ext in a time.Time, an interface value or
+// an int64, which is set to nanoseconds since the Unix epoch.
+func unmarshalTime(buf []byte, rv reflect.Value, d *decodeState) error {
+	loc := d.timeLocation
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	t, err := decodeTimestamp(buf, loc)
+	if err != nil {
+		return d.extError(timestampExt, err)
+	}
+
+	if !rv.CanSet() {
+		return errors.New("msgpack: cannot unmarshal ext to unaddressable value")
+	}
+
+	switch {
+	case rv.Type() == _timeType || rv.Type() == _anyType:
+		rv.Set(reflect.ValueOf(t))
+	case rv.Kind() == reflect.Int64:
+		if t.Before(_minUnixNano) || t.After(_maxUnixNano) {
+			return d.typeError("timestamp "+t.Format(time.RFC3339Nano), rv.Type())
+		}
+		rv.SetInt(t.UnixNano())
+	default:
+		return d.typeError("timestamp", rv.Type())
+	}
+
+	return nil
+}
@@ -0,0 +1,142 @@
+package msgpack_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	msgpack "github.com/cjbottaro/msgpack_go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimestampForms(t *testing.T) {
+	tests := []struct {
+		name string
+		time time.Time
+		data []byte
+	}{
+		{"32", time.Unix(1, 0), []byte{0xd6, 0xff, 0, 0, 0, 1}},
+		{"64", time.Unix(1, 1), []byte{0xd7, 0xff, 0, 0, 0, 0x04, 0, 0, 0, 1}},
+		{"64 max", time.Unix(1<<34-1, 0), []byte{0xd7, 0xff, 0, 0, 0, 0x03, 0xff, 0xff, 0xff, 0xff}},
+		{"96 negative", time.Unix(-1, 500), []byte{0xc7, 0x0c, 0xff, 0, 0, 0x01, 0xf4, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"96 large", time.Unix(1<<34, 0), []byte{0xc7, 0x0c, 0xff, 0, 0, 0, 0, 0, 0, 0, 0x04, 0, 0, 0, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.data, msgpack.MustMarshal(tt.time))
+
+			var out time.Time
+			msgpack.MustUnmarshal(tt.data, &out)
+			require.True(t, tt.time.Equal(out), "expected %v, got %v", tt.time, out)
+			require.Equal(t, time.UTC, out.Location())
+		})
+	}
+}
+
+func TestTimestampBeforeEpoch(t *testing.T) {
+	in := time.Date(1969, 7, 20, 20, 17, 40, 123456789, time.UTC)
+
+	var out time.Time
+	msgpack.MustUnmarshal(msgpack.MustMarshal(in), &out)
+	require.Equal(t, in, out)
+
+	in = time.Date(1, 1, 1, 0, 0, 0, 0, time.UTC)
+	msgpack.MustUnmarshal(msgpack.MustMarshal(in), &out)
+	require.Equal(t, in, out)
+}
+
+func TestTimestampTargets(t *testing.T) {
+	in := time.Date(2024, 11, 25, 2, 19, 12, 33203000, time.UTC)
+	data := msgpack.MustMarshal(in)
+
+	var ptr *time.Time
+	msgpack.MustUnmarshal(data, &ptr)
+	require.Equal(t, in, *ptr)
+
+	var v any
+	msgpack.MustUnmarshal(data, &v)
+	require.Equal(t, in, v)
+
+	var nanos int64
+	msgpack.MustUnmarshal(data, &nanos)
+	require.Equal(t, in.UnixNano(), nanos)
+
+	// Outside the range of int64 nanoseconds.
+	require.Error(t, msgpack.Unmarshal(msgpack.MustMarshal(time.Date(3000, 1, 1, 0, 0, 0, 0, time.UTC)), &nanos))
+
+	var s string
+	require.Error(t, msgpack.Unmarshal(data, &s))
+
+	// Strings from before timestamps were supported still decode.
+	var out time.Time
+	msgpack.MustUnmarshal(msgpack.MustMarshal(in.Format(time.RFC3339Nano)), &out)
+	require.Equal(t, in, out)
+}
+
+func TestTimestampInvalid(t *testing.T) {
+	var out time.Time
+	require.Error(t, msgpack.Unmarshal([]byte{0xd5, 0xff, 0, 0}, &out))
+
+	// Nanoseconds above 999999999.
+	require.Error(t, msgpack.Unmarshal([]byte{0xd7, 0xff, 0xff, 0xff, 0xff, 0xfc, 0, 0, 0, 0}, &out))
+}
+
+func TestDecoderSetTimeLocation(t *testing.T) {
+	loc := time.FixedZone("UTC-3", -3*60*60)
+	in := time.Date(2024, 1, 2, 3, 4, 5, 0, loc)
+
+	dec := msgpack.NewDecoder(bytes.NewReader(msgpack.MustMarshal(in)))
+	dec.SetTimeLocation(loc)
+
+	var out time.Time
+	require.NoError(t, dec.Decode(&out))
+	require.Equal(t, in, out)
+}
+
+func TestTimestampOverride(t *testing.T) {
+	r := msgpack.NewExtRegistry()
+	err := msgpack.RegisterExtTypeIn(r, -1,
+		func(t time.Time) ([]byte, error) {
+			return []byte(t.Format(time.DateOnly)), nil
+		},
+		func(b []byte) (time.Time, error) {
+			return time.Parse(time.DateOnly, string(b))
+		},
+	)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetExtRegistry(r)
+	require.NoError(t, enc.Encode(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)))
+	require.NoError(t, enc.Flush())
+	require.Equal(t, append([]byte{0xc7, 0x0a, 0xff}, "2024-01-02"...), buf.Bytes())
+
+	dec := msgpack.NewDecoder(&buf)
+	dec.SetExtRegistry(r)
+	var out time.Time
+	require.NoError(t, dec.Decode(&out))
+	require.Equal(t, time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), out)
+}
+
+func TestDeprecatedTimeExt(t *testing.T) {
+	// Code from before timestamps were built in registers them itself.
+	r := msgpack.NewExtRegistry()
+	require.NoError(t, r.Register((*time.Time)(nil), -1, msgpack.MarshalTimeExt, msgpack.UnmarshalTimeExt))
+
+	in := time.Date(2024, 11, 25, 2, 19, 12, 33203000, time.UTC)
+
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetExtRegistry(r)
+	require.NoError(t, enc.Encode(in))
+	require.NoError(t, enc.Flush())
+	require.Equal(t, msgpack.MustMarshal(in), buf.Bytes())
+
+	dec := msgpack.NewDecoder(&buf)
+	dec.SetExtRegistry(r)
+	var out any
+	require.NoError(t, dec.Decode(&out))
+	require.Equal(t, in, out)
+}
@@ -1,96 +1,217 @@
 package msgpack
 
 import (
+	"bufio"
 	"bytes"
+	"encoding"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"math"
 	"reflect"
+	"slices"
+	"strconv"
+	"time"
 )
 
-func unmarshalAny(rv reflect.Value, reader *bytes.Reader) error {
-	b, err := reader.ReadByte()
+// byteReader is the source that the unmarshal functions read from. Both
+// *bytes.Reader and *bufio.Reader satisfy it.
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// decodeState is threaded through the unmarshal functions and carries the
+// source along with the options that control decoding, and the bookkeeping
+// for enforcing its limits.
+type decodeState struct {
+	byteReader
+	decodeOptions
+
+	depth     int   // current nesting depth
+	allocated int64 // bytes allocated for the current value
+
+	offset int64 // bytes read from the input so far
+	start  int64 // offset of the value being decoded
+	format byte  // format byte of the value being decoded
+}
+
+type decodeOptions struct {
+	limits         Limits
+	fixedArrayMode FixedArrayMode
+	zeroNil        bool
+	mapMode        MapMode
+	intMode        IntMode
+	keepFloat32    bool
+	exts           *ExtRegistry
+	timeLocation   *time.Location
+}
+
+// MapMode selects the Go type that msgpack maps are decoded into when the
+// target is an interface value.
+type MapMode uint8
+
+const (
+	// MapAuto decodes maps into map[string]any if every key is a string and
+	// into map[any]any otherwise. This is the default.
+	MapAuto MapMode = iota
+
+	// MapAnyKeys always decodes maps into map[any]any.
+	MapAnyKeys
+
+	// MapStringKeys always decodes maps into map[string]any. Keys that aren't
+	// strings are an error.
+	MapStringKeys
+)
+
+// IntMode selects the Go type that msgpack integers are decoded into when the
+// target is an interface value.
+type IntMode uint8
+
+const (
+	// IntAsInt64 decodes signed formats into int64 and unsigned ones into
+	// uint64. This is the default.
+	IntAsInt64 IntMode = iota
+
+	// IntAsInt decodes integers into int, falling back to int64 or uint64
+	// for values too large for an int.
+	IntAsInt
+
+	// IntAsNumber decodes integers into Number.
+	IntAsNumber
+)
+
+// FixedArrayMode controls what happens when a msgpack array or bin is decoded
+// into a Go array of a different length. The zero value treats any mismatch as
+// an error. The modes can be combined.
+type FixedArrayMode uint8
+
+const (
+	// FixedArrayTruncate discards elements beyond the length of the Go array.
+	FixedArrayTruncate FixedArrayMode = 1 << iota
+
+	// FixedArrayZeroFill sets the elements missing from the input to their
+	// zero value.
+	FixedArrayZeroFill
+)
+
+func newDecodeState(r byteReader, opts decodeOptions) *decodeState {
+	return &decodeState{byteReader: r, decodeOptions: opts}
+}
+
+// Read and ReadByte keep track of the offset into the input, for errors.
+
+func (d *decodeState) Read(p []byte) (int, error) {
+	n, err := d.byteReader.Read(p)
+	d.offset += int64(n)
+	return n, err
+}
+
+func (d *decodeState) ReadByte() (byte, error) {
+	b, err := d.byteReader.ReadByte()
+	if err == nil {
+		d.offset++
+	}
+	return b, err
+}
+
+func unmarshalAny(rv reflect.Value, d *decodeState) error {
+	b, err := d.ReadByte()
 	if err != nil {
 		return err
 	}
+	return unmarshalValue(b, rv, d)
+}
+
+// unmarshalValue decodes the value whose first byte, b, has already been read.
+func unmarshalValue(b byte, rv reflect.Value, d *decodeState) error {
+	d.start, d.format = d.offset-1, b
 
 	rv, done := derefPointersAndInterfaces(rv, b)
 	if done {
 		return nil
 	}
 
+	if rv.CanAddr() {
+		if u, ok := rv.Addr().Interface().(Unmarshaler); ok {
+			return unmarshalUnmarshaler(b, u, d)
+		}
+	}
+
 	switch {
+	case b == 0xc0:
+		return unmarshalNil(b, rv, d)
 	case b == 0xc2 || b == 0xc3:
-		return unmarshalBool(b, rv, reader)
+		return unmarshalBool(b, rv, d)
 	case (b & 0b11100000) == 0b11100000:
-		return unmarshalIntFixNeg(b, rv, reader)
+		return unmarshalIntFixNeg(b, rv, d)
 	case (b & 0b10000000) == 0b00000000:
-		return unmarshalIntFixPos(b, rv, reader)
+		return unmarshalIntFixPos(b, rv, d)
 	case b == 0xd0:
-		return unmarshalInt8(b, rv, reader)
+		return unmarshalInt8(b, rv, d)
 	case b == 0xd1:
-		return unmarshalInt16(b, rv, reader)
+		return unmarshalInt16(b, rv, d)
 	case b == 0xd2:
-		return unmarshalInt32(b, rv, reader)
+		return unmarshalInt32(b, rv, d)
 	case b == 0xd3:
-		return unmarshalInt64(b, rv, reader)
+		return unmarshalInt64(b, rv, d)
 	case b == 0xcc:
-		return unmarshalUint8(b, rv, reader)
+		return unmarshalUint8(b, rv, d)
 	case b == 0xcd:
-		return unmarshalUint16(b, rv, reader)
+		return unmarshalUint16(b, rv, d)
 	case b == 0xce:
-		return unmarshalUint32(b, rv, reader)
+		return unmarshalUint32(b, rv, d)
 	case b == 0xcf:
-		return unmarshalUint64(b, rv, reader)
+		return unmarshalUint64(b, rv, d)
 	case b == 0xca:
-		return unmarshalFloat32(b, rv, reader)
+		return unmarshalFloat32(b, rv, d)
 	case b == 0xcb:
-		return unmarshalFloat64(b, rv, reader)
+		return unmarshalFloat64(b, rv, d)
 	case (b & 0b11100000) == 0b10100000:
-		return unmarshalStrFix(b, rv, reader)
+		return unmarshalStrFix(b, rv, d)
 	case b == 0xd9:
-		return unmarshalStr8(b, rv, reader)
+		return unmarshalStr8(b, rv, d)
 	case b == 0xda:
-		return unmarshalStr16(b, rv, reader)
+		return unmarshalStr16(b, rv, d)
 	case b == 0xdb:
-		return unmarshalStr32(b, rv, reader)
+		return unmarshalStr32(b, rv, d)
 	case b == 0xc4:
-		return unmarshalBin8(b, rv, reader)
+		return unmarshalBin8(b, rv, d)
 	case b == 0xc5:
-		return unmarshalBin16(b, rv, reader)
+		return unmarshalBin16(b, rv, d)
 	case b == 0xc6:
-		return unmarshalBin32(b, rv, reader)
+		return unmarshalBin32(b, rv, d)
 	case (b & 0b11110000) == 0b10010000:
-		return unmarshalArrayFix(b, rv, reader)
+		return unmarshalArrayFix(b, rv, d)
 	case b == 0xdc:
-		return unmarshalArray16(b, rv, reader)
+		return unmarshalArray16(b, rv, d)
 	case b == 0xdd:
-		return unmarshalArray32(b, rv, reader)
+		return unmarshalArray32(b, rv, d)
 	case (b & 0b11110000) == 0b10000000:
-		return unmarshalMapFix(b, rv, reader)
+		return unmarshalMapFix(b, rv, d)
 	case b == 0xde:
-		return unmarshalMap16(b, rv, reader)
+		return unmarshalMap16(b, rv, d)
 	case b == 0xdf:
-		return unmarshalMap32(b, rv, reader)
+		return unmarshalMap32(b, rv, d)
 	case b == 0xd4:
-		return unmarshalExtFix1(b, rv, reader)
+		return unmarshalExtFix1(b, rv, d)
 	case b == 0xd5:
-		return unmarshalExtFix2(b, rv, reader)
+		return unmarshalExtFix2(b, rv, d)
 	case b == 0xd6:
-		return unmarshalExtFix4(b, rv, reader)
+		return unmarshalExtFix4(b, rv, d)
 	case b == 0xd7:
-		return unmarshalExtFix8(b, rv, reader)
+		return unmarshalExtFix8(b, rv, d)
 	case b == 0xd8:
-		return unmarshalExtFix16(b, rv, reader)
+		return unmarshalExtFix16(b, rv, d)
 	case b == 0xc7:
-		return unmarshalExt8(b, rv, reader)
+		return unmarshalExt8(b, rv, d)
 	case b == 0xc8:
-		return unmarshalExt16(b, rv, reader)
+		return unmarshalExt16(b, rv, d)
 	case b == 0xc9:
-		return unmarshalExt32(b, rv, reader)
+		return unmarshalExt32(b, rv, d)
 	default:
-		return fmt.Errorf("msgpack: unknown type: 0x%x", b)
+		return syntaxError(b, d.start)
 	}
 }
 
@@ -131,67 +252,110 @@ func derefPointersAndInterfaces(rv reflect.Value, b byte) (reflect.Value, bool)
 	}
 }
 
-func unmarshalBool(b byte, rv reflect.Value, _ *bytes.Reader) error {
-	if rv.Kind() != reflect.Bool {
-		return fmt.Errorf("msgpack: cannot unmarshal boolean into Go value of type %v", rv.Type())
+func unmarshalUnmarshaler(b byte, u Unmarshaler, d *decodeState) error {
+	data, err := appendRawValue(nil, b, d)
+	if err != nil {
+		return err
+	}
+	return u.UnmarshalMsgpack(data)
+}
+
+// unmarshalNil resets maps and slices to nil, pointers and interfaces having
+// already been taken care of. Other values are left unchanged, like
+// encoding/json does, unless the decoder is set to zero them.
+func unmarshalNil(_ byte, rv reflect.Value, d *decodeState) error {
+	if !rv.CanSet() {
+		return nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Map, reflect.Slice:
+		rv.SetZero()
+	default:
+		if d.zeroNil {
+			rv.SetZero()
+		}
+	}
+
+	return nil
+}
+
+func unmarshalBool(b byte, rv reflect.Value, d *decodeState) error {
+	switch {
+	case rv.Kind() == reflect.Bool:
+		rv.SetBool(b == 0xc3)
+	case rv.Type() == _anyType:
+		rv.Set(reflect.ValueOf(b == 0xc3))
+	default:
+		return d.typeError("boolean", rv.Type())
 	}
-	rv.SetBool(b == 0xc3)
 	return nil
 }
 
-func unmarshalIntFixNeg(b byte, rv reflect.Value, _ *bytes.Reader) error {
-	return setInt(int64(int8(b)), rv)
+func unmarshalIntFixNeg(b byte, rv reflect.Value, d *decodeState) error {
+	return setInt(int64(int8(b)), rv, d)
 }
 
-func unmarshalIntFixPos(b byte, rv reflect.Value, _ *bytes.Reader) error {
-	return setInt(int64(b), rv)
+func unmarshalIntFixPos(b byte, rv reflect.Value, d *decodeState) error {
+	return setInt(int64(b), rv, d)
 }
 
-func unmarshalInt8(_ byte, rv reflect.Value, reader *bytes.Reader) error {
+func unmarshalInt8(_ byte, rv reflect.Value, d *decodeState) error {
 	var n int8
-	if err := binary.Read(reader, binary.BigEndian, &n); err != nil {
+	if err := binary.Read(d, binary.BigEndian, &n); err != nil {
 		return err
 	}
-	return setInt(int64(n), rv)
+	return setInt(int64(n), rv, d)
 }
 
-func unmarshalInt16(_ byte, rv reflect.Value, reader *bytes.Reader) error {
+func unmarshalInt16(_ byte, rv reflect.Value, d *decodeState) error {
 	var n int16
-	if err := binary.Read(reader, binary.BigEndian, &n); err != nil {
+	if err := binary.Read(d, binary.BigEndian, &n); err != nil {
 		return err
 	}
-	return setInt(int64(n), rv)
+	return setInt(int64(n), rv, d)
 }
 
-func unmarshalInt32(_ byte, rv reflect.Value, reader *bytes.Reader) error {
+func unmarshalInt32(_ byte, rv reflect.Value, d *decodeState) error {
 	var n int32
-	if err := binary.Read(reader, binary.BigEndian, &n); err != nil {
+	if err := binary.Read(d, binary.BigEndian, &n); err != nil {
 		return err
 	}
-	return setInt(int64(n), rv)
+	return setInt(int64(n), rv, d)
 }
 
-func unmarshalInt64(_ byte, rv reflect.Value, reader *bytes.Reader) error {
+func unmarshalInt64(_ byte, rv reflect.Value, d *decodeState) error {
 	var n int64
-	if err := binary.Read(reader, binary.BigEndian, &n); err != nil {
+	if err := binary.Read(d, binary.BigEndian, &n); err != nil {
 		return err
 	}
-	return setInt(int64(n), rv)
+	return setInt(int64(n), rv, d)
 }
 
-func setInt(v int64, rv reflect.Value) error {
+func setInt(v int64, rv reflect.Value, d *decodeState) error {
 	switch {
 
 	case !rv.CanSet():
 		return fmt.Errorf("msgpack: unmarshal integer to unaddressable value")
 
 	case rv.Kind() == reflect.Interface:
-		rv.Set(reflect.ValueOf(v))
+		switch {
+		case d.intMode == IntAsInt && v >= math.MinInt && v <= math.MaxInt:
+			rv.Set(reflect.ValueOf(int(v)))
+		case d.intMode == IntAsNumber:
+			rv.Set(reflect.ValueOf(Number(strconv.FormatInt(v, 10))))
+		default:
+			rv.Set(reflect.ValueOf(v))
+		}
+		return nil
+
+	case rv.Type() == _numberType:
+		rv.SetString(strconv.FormatInt(v, 10))
 		return nil
 
 	case rv.CanInt():
 		if rv.OverflowInt(v) {
-			return fmt.Errorf("msgpack: cannot unmarshal integer into Go type of %v (overflow)", rv.Type())
+			return d.typeError("integer "+strconv.FormatInt(v, 10), rv.Type())
 		}
 		rv.SetInt(v)
 		return nil
@@ -199,101 +363,109 @@ func setInt(v int64, rv reflect.Value) error {
 	case rv.CanUint():
 		u := uint64(v)
 		if v < 0 || rv.OverflowUint(u) {
-			return fmt.Errorf("msgpack: cannot unmarshal integer into Go type of %v (overflow)", rv.Type())
+			return d.typeError("integer "+strconv.FormatInt(v, 10), rv.Type())
 		}
 		rv.SetUint(u)
 		return nil
 
 	}
 
-	return fmt.Errorf("msgpack: cannot unmarshal integer into Go type of %v", rv.Type())
+	return d.typeError("integer", rv.Type())
 }
 
-func unmarshalUint8(_ byte, rv reflect.Value, reader *bytes.Reader) error {
+func unmarshalUint8(_ byte, rv reflect.Value, d *decodeState) error {
 	var n uint8
-	if err := binary.Read(reader, binary.BigEndian, &n); err != nil {
+	if err := binary.Read(d, binary.BigEndian, &n); err != nil {
 		return err
 	}
-	return setUint(uint64(n), rv)
+	return setUint(uint64(n), rv, d)
 }
 
-func unmarshalUint16(_ byte, rv reflect.Value, reader *bytes.Reader) error {
+func unmarshalUint16(_ byte, rv reflect.Value, d *decodeState) error {
 	var n uint16
-	if err := binary.Read(reader, binary.BigEndian, &n); err != nil {
+	if err := binary.Read(d, binary.BigEndian, &n); err != nil {
 		return err
 	}
-	return setUint(uint64(n), rv)
+	return setUint(uint64(n), rv, d)
 }
 
-func unmarshalUint32(_ byte, rv reflect.Value, reader *bytes.Reader) error {
+func unmarshalUint32(_ byte, rv reflect.Value, d *decodeState) error {
 	var n uint32
-	if err := binary.Read(reader, binary.BigEndian, &n); err != nil {
+	if err := binary.Read(d, binary.BigEndian, &n); err != nil {
 		return err
 	}
-	return setUint(uint64(n), rv)
+	return setUint(uint64(n), rv, d)
 }
 
-func unmarshalUint64(_ byte, rv reflect.Value, reader *bytes.Reader) error {
+func unmarshalUint64(_ byte, rv reflect.Value, d *decodeState) error {
 	var n uint64
-	if err := binary.Read(reader, binary.BigEndian, &n); err != nil {
+	if err := binary.Read(d, binary.BigEndian, &n); err != nil {
 		return err
 	}
-	return setUint(n, rv)
+	return setUint(n, rv, d)
 }
 
-func setUint(v uint64, rv reflect.Value) error {
+func setUint(v uint64, rv reflect.Value, d *decodeState) error {
 	switch {
 
 	case !rv.CanSet():
 		return fmt.Errorf("msgpack: unmarshal unsigned integer to unaddressable value")
 
 	case rv.Kind() == reflect.Interface:
-		rv.Set(reflect.ValueOf(v))
+		switch {
+		case d.intMode == IntAsInt && v <= math.MaxInt:
+			rv.Set(reflect.ValueOf(int(v)))
+		case d.intMode == IntAsNumber:
+			rv.Set(reflect.ValueOf(Number(strconv.FormatUint(v, 10))))
+		default:
+			rv.Set(reflect.ValueOf(v))
+		}
+		return nil
+
+	case rv.Type() == _numberType:
+		rv.SetString(strconv.FormatUint(v, 10))
 		return nil
 
 	case rv.CanUint():
 		if rv.OverflowUint(v) {
-			return fmt.Errorf("msgpack: cannot unmarshal unsigned integer into Go type of %v (overflow)", rv.Type())
+			return d.typeError("unsigned integer "+strconv.FormatUint(v, 10), rv.Type())
 		}
 		rv.SetUint(v)
 		return nil
 
 	case rv.CanInt():
-		switch {
-		case rv.Kind() == reflect.Int64 && v > math.MaxInt64:
-			return fmt.Errorf("msgpack: cannot unmarshal unsigned integer into Go type of %v (overflow)", rv.Type())
-		case rv.Kind() == reflect.Int32 && v > math.MaxInt32:
-			return fmt.Errorf("msgpack: cannot unmarshal unsigned integer into Go type of %v (overflow)", rv.Type())
-		case rv.Kind() == reflect.Int16 && v > math.MaxInt16:
-			return fmt.Errorf("msgpack: cannot unmarshal unsigned integer into Go type of %v (overflow)", rv.Type())
-		case rv.Kind() == reflect.Int8 && v > math.MaxInt8:
-			return fmt.Errorf("msgpack: cannot unmarshal unsigned integer into Go type of %v (overflow)", rv.Type())
+		if v > math.MaxInt64 || rv.OverflowInt(int64(v)) {
+			return d.typeError("unsigned integer "+strconv.FormatUint(v, 10), rv.Type())
 		}
 		rv.SetInt(int64(v))
 		return nil
 
 	}
 
-	return fmt.Errorf("msgpack: cannot unmarshal unsigned integer into Go type of %v", rv.Type())
+	return d.typeError("unsigned integer", rv.Type())
 }
 
-func unmarshalFloat32(_ byte, rv reflect.Value, reader *bytes.Reader) error {
+func unmarshalFloat32(_ byte, rv reflect.Value, d *decodeState) error {
 	var v float32
-	if err := binary.Read(reader, binary.BigEndian, &v); err != nil {
+	if err := binary.Read(d, binary.BigEndian, &v); err != nil {
 		return err
 	}
-	return setFloat(float64(v), rv)
+	if d.keepFloat32 && rv.Kind() == reflect.Interface && rv.CanSet() {
+		rv.Set(reflect.ValueOf(v))
+		return nil
+	}
+	return setFloat(float64(v), rv, d)
 }
 
-func unmarshalFloat64(_ byte, rv reflect.Value, reader *bytes.Reader) error {
+func unmarshalFloat64(_ byte, rv reflect.Value, d *decodeState) error {
 	var v float64
-	if err := binary.Read(reader, binary.BigEndian, &v); err != nil {
+	if err := binary.Read(d, binary.BigEndian, &v); err != nil {
 		return err
 	}
-	return setFloat(float64(v), rv)
+	return setFloat(float64(v), rv, d)
 }
 
-func setFloat(v float64, rv reflect.Value) error {
+func setFloat(v float64, rv reflect.Value, d *decodeState) error {
 	if !rv.CanSet() {
 		return fmt.Errorf("msgpack: cannot unmarshal float to unaddressable value")
 	}
@@ -304,168 +476,223 @@ func setFloat(v float64, rv reflect.Value) error {
 	}
 
 	if !rv.CanFloat() {
-		return fmt.Errorf("msgpack: cannot unmarshal float into Go type of %v", rv.Type())
+		return d.typeError("float", rv.Type())
 	}
 
 	if rv.OverflowFloat(v) {
-		return fmt.Errorf("msgpack: float value overflows float32")
+		return d.typeError("float "+strconv.FormatFloat(v, 'g', -1, 64), rv.Type())
 	}
 
 	rv.SetFloat(v)
 	return nil
 }
 
-func unmarshalStrFix(b byte, rv reflect.Value, reader *bytes.Reader) error {
+func unmarshalStrFix(b byte, rv reflect.Value, d *decodeState) error {
 	l := uint8(b & 0b00011111)
 	if l > 31 {
 		return fmt.Errorf("msgpack: invalid FixStr length %d", l)
 	}
 	var buf [31]byte // Avoid heap allocation.
-	return unmarshalStr(uint32(l), buf[:l], rv, reader)
+	return unmarshalStr(uint32(l), buf[:l], rv, d)
 }
 
-func unmarshalStr8(_ byte, rv reflect.Value, reader *bytes.Reader) error {
+func unmarshalStr8(_ byte, rv reflect.Value, d *decodeState) error {
 	var l uint8
-	if err := binary.Read(reader, binary.BigEndian, &l); err != nil {
+	if err := binary.Read(d, binary.BigEndian, &l); err != nil {
 		return fmt.Errorf("msgpack: unable to read string length: %w", err)
 	}
 	var buf [255]byte
-	return unmarshalStr(uint32(l), buf[:l], rv, reader)
+	return unmarshalStr(uint32(l), buf[:l], rv, d)
 }
 
-func unmarshalStr16(_ byte, rv reflect.Value, reader *bytes.Reader) error {
+func unmarshalStr16(_ byte, rv reflect.Value, d *decodeState) error {
 	var l uint16
-	if err := binary.Read(reader, binary.BigEndian, &l); err != nil {
+	if err := binary.Read(d, binary.BigEndian, &l); err != nil {
 		return fmt.Errorf("msgpack: unable to read string length: %w", err)
 	}
-	return unmarshalStr(uint32(l), nil, rv, reader)
+	return unmarshalStr(uint32(l), nil, rv, d)
 }
 
-func unmarshalStr32(_ byte, rv reflect.Value, reader *bytes.Reader) error {
+func unmarshalStr32(_ byte, rv reflect.Value, d *decodeState) error {
 	var l uint32
-	if err := binary.Read(reader, binary.BigEndian, &l); err != nil {
+	if err := binary.Read(d, binary.BigEndian, &l); err != nil {
 		return fmt.Errorf("msgpack: unable to read string length: %w", err)
 	}
-	return unmarshalStr(l, nil, rv, reader)
+	return unmarshalStr(l, nil, rv, d)
 }
 
-func unmarshalStr(length uint32, buf []byte, rv reflect.Value, reader *bytes.Reader) error {
-	if rv.Kind() != reflect.String && rv.Type() != _anyType {
-		return fmt.Errorf("msgpack: cannot unmarshal string into Go value of type %v", rv.Type())
-	}
+func unmarshalStr(length uint32, buf []byte, rv reflect.Value, d *decodeState) error {
+	tu, isText := cachedTypeInfo(rv.Type()).textUnmarshaler.value(rv)
 
-	if length == 0 {
-		rv.Set(reflect.ValueOf(""))
-		return nil
+	if !isText && rv.Kind() != reflect.String && rv.Type() != _anyType {
+		return d.typeError("string", rv.Type())
 	}
 
-	// TODO maybe implement practical size limit to prevent malicious messages.
+	if err := d.checkLen("MaxStringLen", length, d.limits.MaxStringLen); err != nil {
+		return err
+	}
 
 	// TODO maybe use static allocated buffer for strings up to 1k in size.
 
-	if buf == nil {
-		buf = make([]byte, length)
+	buf, err := d.readData(buf[:0], int(length))
+	if err != nil {
+		return fmt.Errorf("msgpack: unable to read string data: %w", err)
 	}
 
-	if _, err := io.ReadFull(reader, buf); err != nil {
-		return fmt.Errorf("msgpack: unable to read string data: %w", err)
+	switch {
+	case isText:
+		return tu.Interface().(encoding.TextUnmarshaler).UnmarshalText(buf)
+	case rv.Kind() == reflect.String:
+		rv.SetString(string(buf))
+	default:
+		rv.Set(reflect.ValueOf(string(buf)))
 	}
 
-	rv.Set(reflect.ValueOf(string(buf)))
 	return nil
 }
 
-func unmarshalBin8(_ byte, rv reflect.Value, reader *bytes.Reader) error {
+func unmarshalBin8(_ byte, rv reflect.Value, d *decodeState) error {
 	var l uint8
-	if err := binary.Read(reader, binary.BigEndian, &l); err != nil {
+	if err := binary.Read(d, binary.BigEndian, &l); err != nil {
 		return fmt.Errorf("msgpack: unable to read binary length: %w", err)
 	}
 	var buf [255]byte // Stack-allocated buffer for small binaries
-	return unmarshalBin(uint32(l), buf[:l], rv, reader)
+	return unmarshalBin(uint32(l), buf[:l], rv, d)
 }
 
-func unmarshalBin16(_ byte, rv reflect.Value, reader *bytes.Reader) error {
+func unmarshalBin16(_ byte, rv reflect.Value, d *decodeState) error {
 	var l uint16
-	if err := binary.Read(reader, binary.BigEndian, &l); err != nil {
+	if err := binary.Read(d, binary.BigEndian, &l); err != nil {
 		return fmt.Errorf("msgpack: unable to read binary length: %w", err)
 	}
-	return unmarshalBin(uint32(l), nil, rv, reader)
+	return unmarshalBin(uint32(l), nil, rv, d)
 }
 
-func unmarshalBin32(_ byte, rv reflect.Value, reader *bytes.Reader) error {
+func unmarshalBin32(_ byte, rv reflect.Value, d *decodeState) error {
 	var l uint32
-	if err := binary.Read(reader, binary.BigEndian, &l); err != nil {
+	if err := binary.Read(d, binary.BigEndian, &l); err != nil {
 		return fmt.Errorf("msgpack: unable to read binary length: %w", err)
 	}
-	return unmarshalBin(l, nil, rv, reader)
+	return unmarshalBin(l, nil, rv, d)
 }
 
-func unmarshalBin(length uint32, buf []byte, rv reflect.Value, reader *bytes.Reader) error {
-	if rv.Kind() != reflect.Slice || rv.Type().Elem().Kind() != reflect.Uint8 {
-		return fmt.Errorf("msgpack: cannot unmarshal binary into Go value of type %v", rv.Type())
+func unmarshalBin(length uint32, buf []byte, rv reflect.Value, d *decodeState) error {
+	if rv.Type() == _anyType {
+		var v []byte
+		if err := unmarshalBin(length, buf, reflect.ValueOf(&v).Elem(), d); err != nil {
+			return err
+		}
+		rv.Set(reflect.ValueOf(v))
+		return nil
 	}
 
-	if length == 0 {
-		rv.SetBytes(nil)
+	bu, isBinary := cachedTypeInfo(rv.Type()).binaryUnmarshaler.value(rv)
+	isArray := rv.Kind() == reflect.Array && rv.Type().Elem().Kind() == reflect.Uint8
+
+	if !isBinary && !isArray && (rv.Kind() != reflect.Slice || rv.Type().Elem().Kind() != reflect.Uint8) {
+		return d.typeError("binary", rv.Type())
+	}
+
+	if isArray && !isBinary {
+		if err := d.checkFixedArrayLen("binary", length, rv); err != nil {
+			return err
+		}
+	}
+
+	if err := d.checkLen("MaxBinLen", length, d.limits.MaxBinLen); err != nil {
+		return err
+	}
+
+	if length == 0 && !isBinary && !isArray {
+		rv.SetBytes([]byte{}) // nil is reserved for msgpack nil
 		return nil
 	}
 
 	// Use a preallocated buffer if provided or create a new one
-	if buf == nil {
-		buf = make([]byte, length)
+	buf, err := d.readData(buf[:0], int(length))
+	if err != nil {
+		return fmt.Errorf("msgpack: unable to read binary data: %w", err)
 	}
 
-	if _, err := io.ReadFull(reader, buf); err != nil {
-		return fmt.Errorf("msgpack: unable to read binary data: %w", err)
+	switch {
+	case isBinary:
+		return bu.Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(buf)
+	case isArray:
+		n := reflect.Copy(rv, reflect.ValueOf(buf))
+		for i := n; i < rv.Len(); i++ {
+			rv.Index(i).SetZero()
+		}
+	default:
+		rv.SetBytes(buf)
 	}
 
-	rv.SetBytes(buf)
 	return nil
 }
 
-func unmarshalArrayFix(b byte, rv reflect.Value, reader *bytes.Reader) error {
+func unmarshalArrayFix(b byte, rv reflect.Value, d *decodeState) error {
 	length := uint32(b & 0b00001111)
-	return unmarshalArray(length, rv, reader)
+	return unmarshalArray(length, rv, d)
 }
 
-func unmarshalArray16(_ byte, rv reflect.Value, reader *bytes.Reader) error {
+func unmarshalArray16(_ byte, rv reflect.Value, d *decodeState) error {
 	var length uint16
-	if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+	if err := binary.Read(d, binary.BigEndian, &length); err != nil {
 		return fmt.Errorf("msgpack: unable to read array length: %w", err)
 	}
-	return unmarshalArray(uint32(length), rv, reader)
+	return unmarshalArray(uint32(length), rv, d)
 }
 
-func unmarshalArray32(_ byte, rv reflect.Value, reader *bytes.Reader) error {
+func unmarshalArray32(_ byte, rv reflect.Value, d *decodeState) error {
 	var length uint32
-	if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+	if err := binary.Read(d, binary.BigEndian, &length); err != nil {
 		return fmt.Errorf("msgpack: unable to read array length: %w", err)
 	}
-	return unmarshalArray(length, rv, reader)
+	return unmarshalArray(length, rv, d)
 }
 
-func unmarshalArray(length uint32, rv reflect.Value, reader *bytes.Reader) error {
+func unmarshalArray(length uint32, rv reflect.Value, d *decodeState) error {
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+
+	switch rv.Kind() {
+	case reflect.Struct:
+		return unmarshalArrayIntoStruct(length, rv, d)
+	case reflect.Array:
+		return unmarshalIntoArray(length, rv, d)
+	}
+
+	if rv.Kind() != reflect.Slice && rv.Type() != _anyType {
+		return d.typeError("array", rv.Type())
+	}
+
 	var rva reflect.Value = rv
 	if rv.Type() == _anyType {
-		v := make([]any, length)         // Create a slice with the desired length
+		var v []any
 		rva = reflect.ValueOf(&v).Elem() // Create an addressable value
 	}
 
-	if rva.Kind() != reflect.Slice {
-		return fmt.Errorf("msgpack: cannot unmarshal array into Go value of type %v", rv.Type())
+	if err := d.checkCount("MaxArrayLen", length, d.limits.MaxArrayLen, rva.Type().Elem().Size()); err != nil {
+		return err
 	}
 
-	// Ensure the slice has enough capacity
-	if rva.IsNil() || rva.Cap() < int(length) {
-
-		rva.Set(reflect.MakeSlice(rva.Type(), int(length), int(length)))
+	// Ensure the slice has enough capacity, growing it as elements are
+	// decoded if the input might not hold them all.
+	n := d.prealloc(length, rva.Type().Elem().Size())
+	if rva.IsNil() || rva.Cap() < n {
+		rva.Set(reflect.MakeSlice(rva.Type(), n, n))
 	} else {
-		rva.SetLen(int(length)) // Adjust length without reallocation
+		rva.SetLen(n) // Adjust length without reallocation
 	}
 
 	for i := 0; i < int(length); i++ {
-		if err := unmarshalAny(rva.Index(i), reader); err != nil {
-			return fmt.Errorf("msgpack: unable to unmarshal array element %d: %w", i, err)
+		if i == rva.Len() {
+			rva.Grow(1)
+			rva.SetLen(i + 1)
+		}
+		if err := unmarshalAny(rva.Index(i), d); err != nil {
+			return withPath(err, pathElem{index: i})
 		}
 	}
 
@@ -474,28 +701,78 @@ func unmarshalArray(length uint32, rv reflect.Value, reader *bytes.Reader) error
 	return nil
 }
 
-func unmarshalMapFix(b byte, rv reflect.Value, reader *bytes.Reader) error {
+// unmarshalIntoArray fills a Go array, handling a difference in length
+// according to the decoder's FixedArrayMode.
+func unmarshalIntoArray(length uint32, rv reflect.Value, d *decodeState) error {
+	if err := d.checkFixedArrayLen("array", length, rv); err != nil {
+		return err
+	}
+
+	if err := d.checkCount("MaxArrayLen", length, d.limits.MaxArrayLen, 0); err != nil {
+		return err
+	}
+
+	for i := 0; i < int(length); i++ {
+		if i >= rv.Len() {
+			if err := skipAny(d); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := unmarshalAny(rv.Index(i), d); err != nil {
+			return withPath(err, pathElem{index: i})
+		}
+	}
+
+	for i := int(length); i < rv.Len(); i++ {
+		rv.Index(i).SetZero()
+	}
+
+	return nil
+}
+
+// checkFixedArrayLen returns an error if length doesn't match the length of
+// the Go array and the decoder's FixedArrayMode doesn't allow for it.
+func (d *decodeState) checkFixedArrayLen(value string, length uint32, rv reflect.Value) error {
+	n := int64(rv.Len())
+
+	switch {
+	case int64(length) > n && d.fixedArrayMode&FixedArrayTruncate == 0,
+		int64(length) < n && d.fixedArrayMode&FixedArrayZeroFill == 0:
+		return d.typeError(fmt.Sprintf("%s of length %d", value, length), rv.Type())
+	}
+
+	return nil
+}
+
+func unmarshalMapFix(b byte, rv reflect.Value, d *decodeState) error {
 	length := uint32(b & 0b00001111)
-	return unmarshalMap(length, rv, reader)
+	return unmarshalMap(length, rv, d)
 }
 
-func unmarshalMap16(_ byte, rv reflect.Value, reader *bytes.Reader) error {
+func unmarshalMap16(_ byte, rv reflect.Value, d *decodeState) error {
 	var length uint16
-	if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+	if err := binary.Read(d, binary.BigEndian, &length); err != nil {
 		return fmt.Errorf("msgpack: unable to read map length: %w", err)
 	}
-	return unmarshalMap(uint32(length), rv, reader)
+	return unmarshalMap(uint32(length), rv, d)
 }
 
-func unmarshalMap32(_ byte, rv reflect.Value, reader *bytes.Reader) error {
+func unmarshalMap32(_ byte, rv reflect.Value, d *decodeState) error {
 	var length uint32
-	if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+	if err := binary.Read(d, binary.BigEndian, &length); err != nil {
 		return fmt.Errorf("msgpack: unable to read map length: %w", err)
 	}
-	return unmarshalMap(length, rv, reader)
+	return unmarshalMap(length, rv, d)
 }
 
-func unmarshalMap(length uint32, rv reflect.Value, reader *bytes.Reader) error {
+func unmarshalMap(length uint32, rv reflect.Value, d *decodeState) error {
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+
 	// Handle nil maps or structs
 	if rv.Kind() == reflect.Pointer {
 		if rv.IsNil() {
@@ -505,39 +782,114 @@ func unmarshalMap(length uint32, rv reflect.Value, reader *bytes.Reader) error {
 	}
 
 	switch {
-	case rv.Type() == _anyType || rv.Kind() == reflect.Map:
-		return unmarshalIntoMap(length, rv, reader)
+	case rv.Type() == _anyType:
+		return unmarshalIntoAny(length, rv, d)
+	case rv.Kind() == reflect.Map:
+		return unmarshalIntoMap(length, rv, d)
 	case rv.Kind() == reflect.Struct:
-		return unmarshalIntoStruct(length, rv, reader)
+		return unmarshalIntoStruct(length, rv, d)
 	default:
-		return fmt.Errorf("msgpack: cannot unmarshal map into Go value of type %v", rv.Type())
+		return d.typeError("map", rv.Type())
 	}
 }
 
-func unmarshalIntoMap(length uint32, rv reflect.Value, reader *bytes.Reader) error {
+// unmarshalIntoAny decodes a map into an interface value, as the type chosen
+// by the decoder's MapMode.
+func unmarshalIntoAny(length uint32, rv reflect.Value, d *decodeState) error {
+	var rvm reflect.Value
+
+	switch d.mapMode {
+	case MapAnyKeys:
+		rvm = reflect.ValueOf(&map[any]any{}).Elem()
+	case MapStringKeys:
+		rvm = reflect.ValueOf(&map[string]any{}).Elem()
+	default:
+		return unmarshalIntoAutoMap(length, rv, d)
+	}
+
+	if err := unmarshalIntoMap(length, rvm, d); err != nil {
+		return err
+	}
+	rv.Set(rvm)
+	return nil
+}
+
+// unmarshalIntoAutoMap decodes a map into a map[string]any, switching over to
+// a map[any]any if a key turns out not to be a string.
+func unmarshalIntoAutoMap(length uint32, rv reflect.Value, d *decodeState) error {
+	if err := d.checkCount("MaxMapLen", length, d.limits.MaxMapLen, 2*_anyType.Size()); err != nil {
+		return err
+	}
+
+	m := make(map[string]any, d.prealloc(length, 2*_anyType.Size()))
+	var mAny map[any]any
+
+	for i := uint32(0); i < length; i++ {
+		var key any
+		rvk := reflect.ValueOf(&key).Elem()
+		if err := unmarshalAny(rvk, d); err != nil {
+			return err
+		}
+
+		var value any
+		if err := unmarshalAny(reflect.ValueOf(&value).Elem(), d); err != nil {
+			return withPath(err, pathElem{key: rvk})
+		}
+
+		s, isString := key.(string)
+		if isString && mAny == nil {
+			m[s] = value
+			continue
+		}
+
+		if mAny == nil {
+			mAny = make(map[any]any, d.prealloc(length, 2*_anyType.Size()))
+			for k, v := range m {
+				mAny[k] = v
+			}
+		}
+		if key != nil && !reflect.TypeOf(key).Comparable() {
+			return d.typeError("map with "+reflect.TypeOf(key).String()+" key", _anyType)
+		}
+		mAny[key] = value
+	}
+
+	if mAny != nil {
+		rv.Set(reflect.ValueOf(mAny))
+	} else {
+		rv.Set(reflect.ValueOf(m))
+	}
+	return nil
+}
+
+func unmarshalIntoMap(length uint32, rv reflect.Value, d *decodeState) error {
 	var rvm reflect.Value = rv
 
-	if rvm.Type() == _anyType {
-		v := map[any]any{}
-		rvm = reflect.ValueOf(&v).Elem()
-	} else if rvm.IsNil() {
+	if rvm.IsNil() {
 		rvm.Set(reflect.MakeMap(rvm.Type()))
 	}
 
 	keyType := rvm.Type().Key()
 	valueType := rvm.Type().Elem()
 
+	if err := d.checkCount("MaxMapLen", length, d.limits.MaxMapLen, keyType.Size()+valueType.Size()); err != nil {
+		return err
+	}
+
 	for i := uint32(0); i < length; i++ {
 		// Unmarshal key
 		key := reflect.New(keyType).Elem()
-		if err := unmarshalAny(key, reader); err != nil {
-			return fmt.Errorf("msgpack: unable to unmarshal map key: %w", err)
+		if err := unmarshalAny(key, d); err != nil {
+			return err
+		}
+		if key.Kind() == reflect.Interface && !key.IsNil() && !key.Elem().Type().Comparable() {
+			return d.typeError("map with "+key.Elem().Type().String()+" key", rvm.Type())
 		}
 
 		// Unmarshal value
 		value := reflect.New(valueType).Elem()
-		if err := unmarshalAny(value, reader); err != nil {
-			return fmt.Errorf("msgpack: unable to unmarshal map value: %w", err)
+		if err := unmarshalAny(value, d); err != nil {
+			return withPath(err, pathElem{key: key})
 		}
 
 		// Set key-value pair in map
@@ -548,128 +900,327 @@ func unmarshalIntoMap(length uint32, rv reflect.Value, reader *bytes.Reader) err
 	return nil
 }
 
-func unmarshalIntoStruct(length uint32, rv reflect.Value, reader *bytes.Reader) error {
-
-	// Build the struct field map, excluding any fields that should be skipped via
-	// tags, etc.
-	rt := rv.Type()
-	fieldMap := map[string]int{}
-	for i := 0; i < rt.NumField(); i++ {
-		field := rt.Field(i)
-		if name := structFieldName(field); name != "" {
-			fieldMap[name] = i
-		}
+func unmarshalIntoStruct(length uint32, rv reflect.Value, d *decodeState) error {
+	if err := d.checkCount("MaxMapLen", length, d.limits.MaxMapLen, 0); err != nil {
+		return err
 	}
 
+	fields := cachedTypeFields(rv.Type())
+
+	// String keys are read into a reused buffer, which the field lookup
+	// converts to a string without allocating.
+	var key []byte
+
 	for i := uint32(0); i < length; i++ {
-		// Unmarshal key
-		var key string
-		if err := unmarshalAny(reflect.ValueOf(&key).Elem(), reader); err != nil {
-			return fmt.Errorf("msgpack: unable to unmarshal struct key: %w", err)
+		// Unmarshal key and find the corresponding struct field
+		f, buf, err := unmarshalStructKey(fields, key[:0], d)
+		if err != nil {
+			return err
 		}
+		key = buf
 
-		// Find the corresponding struct field
-		fieldIndex, ok := fieldMap[key]
-		if !ok {
-			var v any
-			if err := unmarshalAny(reflect.ValueOf(&v), reader); err != nil {
-				return fmt.Errorf("msgpack: unable to skip unknown struct field: %w", err)
+		if f == nil {
+			if err := skipAny(d); err != nil {
+				return err
 			}
 			continue
 		}
 
 		// Unmarshal value into the field
-		field := rv.Field(fieldIndex)
+		field, err := fieldByIndexAlloc(rv, f.index)
+		if err != nil {
+			return err
+		}
 		if !field.CanSet() {
-			return fmt.Errorf("msgpack: cannot set field %s in struct %v", key, rv.Type())
+			return fmt.Errorf("msgpack: cannot set field %s in struct %v", f.name, rv.Type())
+		}
+		unmarshalFn := unmarshalAny
+		if f.quoted {
+			unmarshalFn = unmarshalQuoted
+		}
+		if err := unmarshalFn(field, d); err != nil {
+			return withPath(err, pathElem{name: f.name})
+		}
+	}
+
+	return nil
+}
+
+// unmarshalArrayIntoStruct fills the struct's fields positionally, in the
+// order they are declared. Extra elements are discarded and missing ones leave
+// the remaining fields untouched.
+func unmarshalArrayIntoStruct(length uint32, rv reflect.Value, d *decodeState) error {
+	if err := d.checkCount("MaxArrayLen", length, d.limits.MaxArrayLen, 0); err != nil {
+		return err
+	}
+
+	fields := cachedTypeFields(rv.Type()).list
+
+	for i := 0; i < int(length); i++ {
+		if i >= len(fields) {
+			if err := skipAny(d); err != nil {
+				return err
+			}
+			continue
+		}
+
+		f := &fields[i]
+		field, err := fieldByIndexAlloc(rv, f.index)
+		if err != nil {
+			return err
+		}
+		unmarshalFn := unmarshalAny
+		if f.quoted {
+			unmarshalFn = unmarshalQuoted
+		}
+		if err := unmarshalFn(field, d); err != nil {
+			return withPath(err, pathElem{name: f.name})
+		}
+	}
+
+	return nil
+}
+
+// unmarshalStructKey reads a map key and returns the struct field it refers
+// to, or nil if there isn't one. String keys are read into buf, which is
+// returned for reuse. Integer keys match fields tagged keyasint, and keys of
+// any other type never match.
+func unmarshalStructKey(fields *structFields, buf []byte, d *decodeState) (*field, []byte, error) {
+	b, err := d.ReadByte()
+	if err != nil {
+		return nil, buf, err
+	}
+
+	var length uint32
+	switch {
+	case (b & 0b11100000) == 0b10100000:
+		length = uint32(b & 0b00011111)
+	case b == 0xd9:
+		var l uint8
+		err = binary.Read(d, binary.BigEndian, &l)
+		length = uint32(l)
+	case b == 0xda:
+		var l uint16
+		err = binary.Read(d, binary.BigEndian, &l)
+		length = uint32(l)
+	case b == 0xdb:
+		err = binary.Read(d, binary.BigEndian, &length)
+	case b == 0xcf: // uint64, which may be too large for any field's key
+		var n uint64
+		if err := unmarshalValue(b, reflect.ValueOf(&n).Elem(), d); err != nil {
+			return nil, buf, err
+		}
+		if i, ok := fields.byInt[int64(n)]; ok && n <= math.MaxInt64 {
+			return &fields.list[i], buf, nil
+		}
+		return nil, buf, nil
+	case b <= 0x7f || b >= 0xe0 || (b >= 0xcc && b <= 0xd3): // integer
+		var n int64
+		if err := unmarshalValue(b, reflect.ValueOf(&n).Elem(), d); err != nil {
+			return nil, buf, err
+		}
+		if i, ok := fields.byInt[n]; ok {
+			return &fields.list[i], buf, nil
+		}
+		return nil, buf, nil
+	default:
+		return nil, buf, skipValue(b, d)
+	}
+	if err != nil {
+		return nil, buf, fmt.Errorf("msgpack: unable to read string length: %w", err)
+	}
+
+	// The key is read into buf, which is reused for every key.
+	if err := d.checkSize("MaxStringLen", length, d.limits.MaxStringLen); err != nil {
+		return nil, buf, err
+	}
+
+	if buf, err = d.readData(buf[:0], int(length)); err != nil {
+		return nil, buf, fmt.Errorf("msgpack: unable to read string data: %w", err)
+	}
+
+	if i, ok := fields.byName[string(buf)]; ok {
+		return &fields.list[i], buf, nil
+	}
+	return nil, buf, nil
+}
+
+// unmarshalQuoted implements the string tag option, parsing a boolean or
+// numeric value out of a msgpack string. Values that were not encoded as
+// strings are unmarshaled as usual.
+func unmarshalQuoted(rv reflect.Value, d *decodeState) error {
+	b, err := d.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	if (b&0b11100000) != 0b10100000 && b != 0xd9 && b != 0xda && b != 0xdb {
+		return unmarshalValue(b, rv, d)
+	}
+
+	rv, _ = derefPointersAndInterfaces(rv, b)
+
+	var s string
+	if err := unmarshalValue(b, reflect.ValueOf(&s).Elem(), d); err != nil {
+		return err
+	}
+
+	switch rv.Kind() {
+	case reflect.Bool:
+		v, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("msgpack: invalid use of string option, trying to unmarshal %q into %v", s, rv.Type())
+		}
+		rv.SetBool(v)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("msgpack: invalid use of string option, trying to unmarshal %q into %v", s, rv.Type())
 		}
-		if err := unmarshalAny(field, reader); err != nil {
-			return fmt.Errorf("msgpack: unable to unmarshal struct field %s: %w", key, err)
+		return setInt(v, rv, d)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("msgpack: invalid use of string option, trying to unmarshal %q into %v", s, rv.Type())
 		}
+		return setUint(v, rv, d)
+	case reflect.Float32, reflect.Float64:
+		v, err := strconv.ParseFloat(s, rv.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("msgpack: invalid use of string option, trying to unmarshal %q into %v", s, rv.Type())
+		}
+		return setFloat(v, rv, d)
+	case reflect.String:
+		rv.SetString(s)
+	default:
+		return d.typeError("string", rv.Type())
 	}
 
 	return nil
 }
 
-func unmarshalExtFix1(_ byte, rv reflect.Value, reader *bytes.Reader) error {
+func unmarshalExtFix1(_ byte, rv reflect.Value, d *decodeState) error {
 	var buf [1]byte
-	return unmarshalExt(buf[:], rv, reader)
+	return unmarshalExt(buf[:0], 1, rv, d)
 }
 
-func unmarshalExtFix2(_ byte, rv reflect.Value, reader *bytes.Reader) error {
+func unmarshalExtFix2(_ byte, rv reflect.Value, d *decodeState) error {
 	var buf [2]byte
-	return unmarshalExt(buf[:], rv, reader)
+	return unmarshalExt(buf[:0], 2, rv, d)
 }
 
-func unmarshalExtFix4(_ byte, rv reflect.Value, reader *bytes.Reader) error {
+func unmarshalExtFix4(_ byte, rv reflect.Value, d *decodeState) error {
 	var buf [4]byte
-	return unmarshalExt(buf[:], rv, reader)
+	return unmarshalExt(buf[:0], 4, rv, d)
 }
 
-func unmarshalExtFix8(_ byte, rv reflect.Value, reader *bytes.Reader) error {
+func unmarshalExtFix8(_ byte, rv reflect.Value, d *decodeState) error {
 	var buf [8]byte
-	return unmarshalExt(buf[:], rv, reader)
+	return unmarshalExt(buf[:0], 8, rv, d)
 }
 
-func unmarshalExtFix16(_ byte, rv reflect.Value, reader *bytes.Reader) error {
+func unmarshalExtFix16(_ byte, rv reflect.Value, d *decodeState) error {
 	var buf [16]byte
-	return unmarshalExt(buf[:], rv, reader)
+	return unmarshalExt(buf[:0], 16, rv, d)
 }
 
-func unmarshalExt8(_ byte, rv reflect.Value, reader *bytes.Reader) error {
+func unmarshalExt8(_ byte, rv reflect.Value, d *decodeState) error {
 	var size uint8
-	if err := binary.Read(reader, binary.BigEndian, &size); err != nil {
+	if err := binary.Read(d, binary.BigEndian, &size); err != nil {
 		return err
 	}
-	return unmarshalExtSize(uint32(size), rv, reader)
+	return unmarshalExtSize(uint32(size), rv, d)
 }
 
-func unmarshalExt16(_ byte, rv reflect.Value, reader *bytes.Reader) error {
+func unmarshalExt16(_ byte, rv reflect.Value, d *decodeState) error {
 	var size uint16
-	if err := binary.Read(reader, binary.BigEndian, &size); err != nil {
+	if err := binary.Read(d, binary.BigEndian, &size); err != nil {
 		return err
 	}
-	return unmarshalExtSize(uint32(size), rv, reader)
+	return unmarshalExtSize(uint32(size), rv, d)
 }
 
-func unmarshalExt32(_ byte, rv reflect.Value, reader *bytes.Reader) error {
+func unmarshalExt32(_ byte, rv reflect.Value, d *decodeState) error {
 	var size uint32
-	if err := binary.Read(reader, binary.BigEndian, &size); err != nil {
+	if err := binary.Read(d, binary.BigEndian, &size); err != nil {
 		return err
 	}
-	return unmarshalExtSize(uint32(size), rv, reader)
+	return unmarshalExtSize(uint32(size), rv, d)
 }
 
-func unmarshalExtSize(size uint32, rv reflect.Value, reader *bytes.Reader) error {
-	return unmarshalExt(make([]byte, size), rv, reader)
+func unmarshalExtSize(size uint32, rv reflect.Value, d *decodeState) error {
+	if err := d.checkLen("MaxExtLen", size, d.limits.MaxExtLen); err != nil {
+		return err
+	}
+	return unmarshalExt(nil, size, rv, d)
 }
 
-func unmarshalExt(buf []byte, rv reflect.Value, reader *bytes.Reader) error {
-	id, err := reader.ReadByte()
+// unmarshalExt reads an ext's type and size bytes of data, using buf's
+// capacity if it is large enough.
+func unmarshalExt(buf []byte, size uint32, rv reflect.Value, d *decodeState) error {
+	id, err := d.ReadByte()
 	if err != nil {
 		return err
 	}
 
-	handler, ok := _extRegistryById[int8(id)]
-	if !ok {
-		return fmt.Errorf("msgpack: unregistered ext: 0x%x", id)
+	handler, ok := d.exts.byId(int8(id))
+	isTime := !ok && int8(id) == timestampExt
+	isRaw := rv.Type() == _rawExtType || (!ok && !isTime && rv.Type() == _anyType)
+	if !ok && !isRaw && !isTime {
+		return d.extError(int8(id), errUnregisteredExt)
+	}
+
+	if handler.decodeFn != nil && !isRaw {
+		v, err := decodeNestedExt(handler, size, d)
+		if err != nil {
+			// An error from an ext further in already says which one
+			// failed, and wrapping it again at every level would grow
+			// with the nesting.
+			var ee *ExtError
+			if errors.As(err, &ee) {
+				return err
+			}
+			return d.extError(int8(id), finishPath(err))
+		}
+		return setExtValue(v, rv, d)
 	}
 
-	_, err = io.ReadFull(reader, buf)
+	buf, err = d.readData(buf, int(size))
 	if err != nil {
 		return err
 	}
 
+	if isRaw {
+		if !rv.CanSet() {
+			return fmt.Errorf("msgpack: cannot unmarshal ext to unaddressable value")
+		}
+		rv.Set(reflect.ValueOf(RawExt{Type: int8(id), Data: bytes.Clone(buf)}))
+		return nil
+	}
+
+	if isTime {
+		return unmarshalTime(buf, rv, d)
+	}
+
 	v, err := handler.unmarshalFn(buf)
 	if err != nil {
-		return err
+		return d.extError(int8(id), err)
+	}
+
+	return setExtValue(v, rv, d)
+}
+
+// setExtValue stores v, as returned for an ext by its handler, in rv.
+func setExtValue(v any, rv reflect.Value, d *decodeState) error {
+	if !rv.CanSet() {
+		return fmt.Errorf("msgpack: cannot unmarshal ext to unaddressable value")
 	}
 
 	rval := reflect.ValueOf(v)
 
 	if rv.Type() != rval.Type() {
 		if !rval.CanConvert(rv.Type()) {
-			return fmt.Errorf("msgpack: cannot unmarshal %v into Go value of type %v", rval.Type(), rv.Type())
+			return d.typeError(rval.Type().String(), rv.Type())
 		}
 		rval = rval.Convert(rv.Type())
 	}
@@ -677,3 +1228,302 @@ func unmarshalExt(buf []byte, rv reflect.Value, reader *bytes.Reader) error {
 	rv.Set(rval)
 	return nil
 }
+
+// decodeNestedExt decodes the data of an ext registered with
+// RegisterNestedExtIn in place, with a Decoder that carries on from d.
+func decodeNestedExt(handler extHandler, size uint32, d *decodeState) (any, error) {
+	// Read straight from the input rather than through the readers of any
+	// enclosing exts, so reading doesn't get slower with each level.
+	r := &extDataReader{r: d.byteReader, n: int64(size)}
+	parent, nested := d.byteReader.(*extDataReader)
+	if nested {
+		r.r = parent.r
+		r.n = min(r.n, parent.n)
+	}
+
+	dec := &Decoder{r: r, opts: d.decodeOptions, offset: d.offset, parent: d}
+	v, err := handler.decodeFn(dec)
+
+	read := min(int64(size), dec.offset-d.offset)
+	d.offset += read
+	if nested {
+		parent.n -= read
+	}
+
+	if err == nil && read != int64(size) {
+		err = fmt.Errorf("msgpack: %d bytes of ext data left over", int64(size)-read)
+	}
+	return v, err
+}
+
+// extDataReader reads the next n bytes of r, which hold an ext's data.
+type extDataReader struct {
+	r byteReader
+	n int64
+}
+
+func (r *extDataReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.n {
+		p = p[:r.n]
+	}
+	n, err := r.r.Read(p)
+	r.n -= int64(n)
+	return n, err
+}
+
+func (r *extDataReader) ReadByte() (byte, error) {
+	if r.n <= 0 {
+		return 0, io.EOF
+	}
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.n--
+	}
+	return b, err
+}
+
+// rawHeader describes the layout of a value from its first byte: the size of
+// its length field, if it has one, and otherwise the number of data bytes and
+// nested values that follow.
+func rawHeader(b byte) (size int, length, count uint64, ok bool) {
+	switch {
+	case b <= 0x7f || b >= 0xe0 || b == 0xc0 || b == 0xc2 || b == 0xc3:
+		// Value is entirely contained in the first byte.
+	case (b & 0b11100000) == 0b10100000:
+		length = uint64(b & 0b00011111)
+	case (b & 0b11110000) == 0b10010000:
+		count = uint64(b & 0b00001111)
+	case (b & 0b11110000) == 0b10000000:
+		count = 2 * uint64(b&0b00001111)
+	case b == 0xcc || b == 0xd0:
+		length = 1
+	case b == 0xcd || b == 0xd1:
+		length = 2
+	case b == 0xce || b == 0xd2 || b == 0xca:
+		length = 4
+	case b == 0xcf || b == 0xd3 || b == 0xcb:
+		length = 8
+	case b == 0xd4:
+		length = 1 + 1 // type + data
+	case b == 0xd5:
+		length = 1 + 2
+	case b == 0xd6:
+		length = 1 + 4
+	case b == 0xd7:
+		length = 1 + 8
+	case b == 0xd8:
+		length = 1 + 16
+	case b == 0xd9 || b == 0xc4 || b == 0xc7:
+		size = 1
+	case b == 0xda || b == 0xc5 || b == 0xc8 || b == 0xdc || b == 0xde:
+		size = 2
+	case b == 0xdb || b == 0xc6 || b == 0xc9 || b == 0xdd || b == 0xdf:
+		size = 4
+	default:
+		return 0, 0, 0, false
+	}
+	return size, length, count, true
+}
+
+// rawLength turns n, read from the length field of a value whose first byte is
+// b, into the number of data bytes and nested values that follow, checking it
+// against the decoder's limits. The data isn't counted towards MaxAlloc, since
+// skipping it allocates nothing.
+func (d *decodeState) rawLength(b byte, n uint64) (length, count uint64, err error) {
+	switch b {
+	case 0xdc, 0xdd:
+		err = d.checkCount("MaxArrayLen", uint32(n), d.limits.MaxArrayLen, 0)
+		count = n
+	case 0xde, 0xdf:
+		err = d.checkCount("MaxMapLen", uint32(n), d.limits.MaxMapLen, 0)
+		count = 2 * n
+	case 0xc7, 0xc8, 0xc9:
+		err = d.checkSize("MaxExtLen", uint32(n), d.limits.MaxExtLen)
+		length = 1 + n // type + data
+	case 0xc4, 0xc5, 0xc6:
+		err = d.checkSize("MaxBinLen", uint32(n), d.limits.MaxBinLen)
+		length = n
+	default:
+		err = d.checkSize("MaxStringLen", uint32(n), d.limits.MaxStringLen)
+		length = n
+	}
+	return length, count, err
+}
+
+// appendRawValue appends the complete encoding of the value whose first byte,
+// b, has already been read to buf, without decoding it.
+func appendRawValue(buf []byte, b byte, d *decodeState) ([]byte, error) {
+	buf = append(buf, b)
+
+	size, length, count, ok := rawHeader(b)
+	if !ok {
+		return buf, syntaxError(b, d.offset-1)
+	}
+
+	if size > 0 {
+		var n uint64
+		for i := 0; i < size; i++ {
+			c, err := d.ReadByte()
+			if err != nil {
+				return buf, err
+			}
+			buf = append(buf, c)
+			n = n<<8 | uint64(c)
+		}
+
+		var err error
+		if length, count, err = d.rawLength(b, n); err != nil {
+			return buf, err
+		}
+		if err := d.alloc(int64(length)); err != nil {
+			return buf, err
+		}
+	}
+
+	if length > 0 {
+		var err error
+		if buf, err = d.readData(buf, int(length)); err != nil {
+			return buf, err
+		}
+	}
+
+	if count > 0 {
+		if err := d.enter(); err != nil {
+			return buf, err
+		}
+		defer d.leave()
+	}
+
+	for i := uint64(0); i < count; i++ {
+		b, err := d.ReadByte()
+		if err != nil {
+			return buf, err
+		}
+		if buf, err = appendRawValue(buf, b, d); err != nil {
+			return buf, err
+		}
+	}
+
+	return buf, nil
+}
+
+// skipValue reads past the value whose first byte, b, has already been read.
+// It only looks at headers, so nothing is allocated and ext data is never
+// decoded.
+func skipValue(b byte, d *decodeState) error {
+	size, length, count, ok := rawHeader(b)
+	if !ok {
+		return syntaxError(b, d.offset-1)
+	}
+
+	if size > 0 {
+		var n uint64
+		for i := 0; i < size; i++ {
+			c, err := d.ReadByte()
+			if err != nil {
+				return err
+			}
+			n = n<<8 | uint64(c)
+		}
+
+		var err error
+		if length, count, err = d.rawLength(b, n); err != nil {
+			return err
+		}
+	}
+
+	if err := d.discard(length); err != nil {
+		return err
+	}
+
+	if count > 0 {
+		if err := d.enter(); err != nil {
+			return err
+		}
+		defer d.leave()
+	}
+
+	for i := uint64(0); i < count; i++ {
+		b, err := d.ReadByte()
+		if err != nil {
+			return err
+		}
+		if err := skipValue(b, d); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// skipAny is like skipValue, for a value that hasn't been started yet.
+func skipAny(d *decodeState) error {
+	b, err := d.ReadByte()
+	if err != nil {
+		return err
+	}
+	return skipValue(b, d)
+}
+
+// readData appends the next n bytes of input to buf. Input whose length isn't
+// known is read a chunk at a time, so that a header claiming gigabytes only
+// costs memory as the bytes actually arrive.
+func (d *decodeState) readData(buf []byte, n int) ([]byte, error) {
+	for n > 0 {
+		chunk := n
+		if !d.sized() {
+			chunk = min(n, max(readChunk, len(buf)))
+		}
+
+		start := len(buf)
+		buf = slices.Grow(buf, chunk)[:start+chunk]
+		if _, err := io.ReadFull(d, buf[start:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return buf, err
+		}
+		n -= chunk
+	}
+	return buf, nil
+}
+
+// discard reads past the next n bytes of input, without copying them
+// anywhere if the source allows it.
+func (d *decodeState) discard(n uint64) error {
+	if n == 0 {
+		return nil
+	}
+
+	switch r := d.byteReader.(type) {
+	case *bytes.Reader:
+		if n > uint64(r.Len()) {
+			d.offset += int64(r.Len())
+			r.Seek(0, io.SeekEnd)
+			return io.ErrUnexpectedEOF
+		}
+		r.Seek(int64(n), io.SeekCurrent)
+		d.offset += int64(n)
+		return nil
+	case *bufio.Reader:
+		m, err := r.Discard(int(n))
+		d.offset += int64(m)
+		if errors.Is(err, io.EOF) {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	for i := uint64(0); i < n; i++ {
+		if _, err := d.ReadByte(); err != nil {
+			if errors.Is(err, io.EOF) {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+	return nil
+}